@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -13,34 +15,51 @@ import (
 )
 
 type Config struct {
-	LogLevel            int      `toml:"log_level"`
-	LogFile             *string  `toml:"log_file"`
-	UseSyslog           bool     `toml:"use_syslog"`
-	ServerNames         []string `toml:"server_names"`
-	ListenAddresses     []string `toml:"listen_addresses"`
-	Daemonize           bool
-	ForceTCP            bool `toml:"force_tcp"`
-	Timeout             int  `toml:"timeout_ms"`
-	CertRefreshDelay    int  `toml:"cert_refresh_delay"`
-	CertIgnoreTimestamp bool `toml:"cert_ignore_timestamp"`
-	BlockIPv6           bool `toml:"block_ipv6"`
-	Cache               bool
-	CacheSize           int                     `toml:"cache_size"`
-	CacheNegTTL         uint32                  `toml:"cache_neg_ttl"`
-	CacheMinTTL         uint32                  `toml:"cache_min_ttl"`
-	CacheMaxTTL         uint32                  `toml:"cache_max_ttl"`
-	QueryLog            QueryLogConfig          `toml:"query_log"`
-	NxLog               NxLogConfig             `toml:"nx_log"`
-	BlockName           BlockNameConfig         `toml:"blacklist"`
-	BlockIP             BlockIPConfig           `toml:"ip_blacklist"`
-	ForwardFile         string                  `toml:"forwarding_rules"`
-	ServersConfig       map[string]ServerConfig `toml:"static"`
-	SourcesConfig       map[string]SourceConfig `toml:"sources"`
-	SourceRequireDNSSEC bool                    `toml:"require_dnssec"`
-	SourceRequireNoLog  bool                    `toml:"require_nolog"`
-	SourceIPv4          bool                    `toml:"ipv4_servers"`
-	SourceIPv6          bool                    `toml:"ipv6_servers"`
-	MaxClients          uint32                  `toml:"max_clients"`
+	LogLevel              int      `toml:"log_level"`
+	LogFile               *string  `toml:"log_file"`
+	UseSyslog             bool     `toml:"use_syslog"`
+	ServerNames           []string `toml:"server_names"`
+	ListenAddresses       []string `toml:"listen_addresses"`
+	Daemonize             bool
+	ForceTCP              bool `toml:"force_tcp"`
+	Timeout               int  `toml:"timeout_ms"`
+	CertRefreshDelay      int  `toml:"cert_refresh_delay"`
+	CertIgnoreTimestamp   bool `toml:"cert_ignore_timestamp"`
+	BlockIPv6             bool `toml:"block_ipv6"`
+	Cache                 bool
+	CacheSize             int                     `toml:"cache_size"`
+	CacheNegTTL           uint32                  `toml:"cache_neg_ttl"`
+	CacheMinTTL           uint32                  `toml:"cache_min_ttl"`
+	CacheMaxTTL           uint32                  `toml:"cache_max_ttl"`
+	QueryLog              QueryLogConfig          `toml:"query_log"`
+	NxLog                 NxLogConfig             `toml:"nx_log"`
+	BlockName             BlockNameConfig         `toml:"blacklist"`
+	BlockIP               BlockIPConfig           `toml:"ip_blacklist"`
+	ForwardFile           string                  `toml:"forwarding_rules"`
+	ServersConfig         map[string]ServerConfig `toml:"static"`
+	SourcesConfig         map[string]SourceConfig `toml:"sources"`
+	SourceRequireDNSSEC   bool                    `toml:"require_dnssec"`
+	SourceRequireNoLog    bool                    `toml:"require_nolog"`
+	SourceRequireNoFilter bool                    `toml:"require_nofilter"`
+	SourceIPv4            bool                    `toml:"ipv4_servers"`
+	SourceIPv6            bool                    `toml:"ipv6_servers"`
+	SourcesLogProtocols   bool                    `toml:"log_sources_protocols"`
+	SourcesRefreshDelay   map[string]int          `toml:"sources_refresh_delay"`
+	ServersBlacklistFile  string                  `toml:"servers_blacklist_file"`
+	ServersOverrideFile   string                  `toml:"servers_override_file"`
+	SourcesHTTPProxy      string                  `toml:"sources_http_proxy"`
+	SourcesSOCKSProxy     string                  `toml:"sources_socks5_proxy"`
+	SourcesMinTLSVersion  string                  `toml:"sources_min_tls_version"`
+	SourcesMemoryCache    bool                    `toml:"sources_memory_cache"`
+	SourcesCompressCache  bool                    `toml:"sources_compress_cache"`
+	SourcesOffline        bool                    `toml:"sources_offline"`
+	SourcesResolver       string                  `toml:"sources_bootstrap_resolver"`
+	SourcesJitter         int                     `toml:"sources_refresh_jitter"`
+	SourcesJitterSeed     string                  `toml:"sources_refresh_jitter_seed"`
+	SourcesMaxFetches     int                     `toml:"sources_max_concurrent_fetches"`
+	SourcesIdleTimeout    int                     `toml:"sources_idle_timeout"`
+	SourcesNegativeTTL    int                     `toml:"sources_negative_cache_ttl"`
+	MaxClients            uint32                  `toml:"max_clients"`
 }
 
 func newConfig() Config {
@@ -58,6 +77,7 @@ func newConfig() Config {
 		SourceRequireNoLog:  true,
 		SourceIPv4:          true,
 		SourceIPv6:          false,
+		SourcesLogProtocols: true,
 		MaxClients:          100,
 	}
 }
@@ -67,12 +87,37 @@ type ServerConfig struct {
 }
 
 type SourceConfig struct {
-	URL            string
-	MinisignKeyStr string `toml:"minisign_key"`
-	CacheFile      string `toml:"cache_file"`
-	FormatStr      string `toml:"format"`
-	RefreshDelay   int    `toml:"refresh_delay"`
-	Prefix         string
+	URL                 string
+	MinisignKeyStr      string `toml:"minisign_key"`
+	CacheFile           string `toml:"cache_file"`
+	FormatStr           string `toml:"format"`
+	RefreshDelay        int    `toml:"refresh_delay"`
+	Prefix              string
+	RequireDNSSEC       bool `toml:"require_dnssec"`
+	FormatFallback      bool `toml:"format_fallback"`
+	Headers             map[string]string
+	ParseMode           string `toml:"parse_mode"`
+	FetchAttempts       int    `toml:"fetch_attempts"`
+	FetchTimeout        int    `toml:"fetch_timeout"`
+	Mirrors             []string
+	MaxSize             int      `toml:"max_size"`
+	InsecureNoSignature bool     `toml:"insecure_no_signature_verification"`
+	SignatureWarnOnly   bool     `toml:"signature_warn_only"`
+	PinOnFirstUse       bool     `toml:"pin_on_first_use"`
+	IgnoreContentType   bool     `toml:"ignore_content_type"`
+	SameDomainRedirects bool     `toml:"same_domain_redirects"`
+	SPKIPins            []string `toml:"spki_pins"`
+	MaxShrinkPercent    int      `toml:"max_shrink_percent"`
+	StaleCacheExpiry    int      `toml:"stale_cache_expiry"`
+	UserAgent           string   `toml:"user_agent"`
+	AllowPrivateAddrs   bool     `toml:"allow_private_addresses"`
+	AddressFamily       string   `toml:"address_family"`
+	ResolveHostnames    bool     `toml:"address_family_resolve"`
+	ResumeDownloads     bool     `toml:"resume_downloads"`
+	SignatureAlgorithms []string `toml:"signature_algorithms"`
+	InlineSignature     string   `toml:"minisig"`
+	Username            string
+	Password            string
 }
 
 type QueryLogConfig struct {
@@ -102,6 +147,11 @@ func ConfigLoad(proxy *Proxy, svcFlag *string, config_file string) error {
 	version := flag.Bool("version", false, "Prints current proxy version")
 	configFile := flag.String("config", "dnscrypt-proxy.toml", "Path to the configuration file")
 	resolve := flag.String("resolve", "", "resolve a name using system libraries")
+	flag.StringVar(&StdinSourceSigFile, "stdin-source-signature", "", "signature file for a source read from the standard input (url = '-')")
+	prewarmCaches := flag.Bool("prewarm-caches", false, "download and verify all sources into their cache files, then exit")
+	pruneCache := flag.Bool("prune-cache", false, "remove the signatures and metadata files of sources that are no longer configured, then exit")
+	pruneDryRun := flag.Bool("prune-cache-dry-run", false, "print the files that -prune-cache would remove, then exit")
+	validateSource := flag.String("validate-source", "", "parse a local source file (- for the standard input), print warnings about its entries, then exit")
 	flag.Parse()
 	if *svcFlag == "stop" || *svcFlag == "uninstall" {
 		return nil
@@ -114,10 +164,56 @@ func ConfigLoad(proxy *Proxy, svcFlag *string, config_file string) error {
 		Resolve(*resolve)
 		os.Exit(0)
 	}
+	if len(*validateSource) > 0 {
+		registeredServers, warnings, err := ValidateSourceFile(*validateSource, "auto")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Println(warning)
+		}
+		fmt.Printf("%d servers, %d warnings\n", len(registeredServers), len(warnings))
+		os.Exit(0)
+	}
 	config := newConfig()
 	if _, err := toml.DecodeFile(*configFile, &config); err != nil {
 		return err
 	}
+	if *prewarmCaches {
+		failures := 0
+		report, err := PrewarmCaches(&config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for sourceName, err := range report {
+			if err != nil {
+				fmt.Printf("[%s] FAILED: %s\n", sourceName, err)
+				failures++
+			} else {
+				fmt.Printf("[%s] OK\n", sourceName)
+			}
+		}
+		if failures > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *pruneCache || *pruneDryRun {
+		activeCacheFiles, cacheDirs := config.sourcesCacheFiles()
+		for _, cacheDir := range cacheDirs {
+			removed, err := Compact(cacheDir, activeCacheFiles, *pruneDryRun)
+			for _, file := range removed {
+				fmt.Println(file)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		os.Exit(0)
+	}
 	if config.LogLevel >= 0 && config.LogLevel < int(dlog.SeverityLast) {
 		dlog.SetLogLevel(dlog.Severity(config.LogLevel))
 	}
@@ -199,47 +295,69 @@ func ConfigLoad(proxy *Proxy, svcFlag *string, config_file string) error {
 
 	proxy.forwardFile = config.ForwardFile
 
-	requiredProps := ServerInformalProperties(0)
-	if config.SourceRequireDNSSEC {
-		requiredProps |= ServerInformalPropertyDNSSEC
-	}
-	if config.SourceRequireNoLog {
-		requiredProps |= ServerInformalPropertyNoLog
-	}
+	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
 
-	for cfgSourceName, cfgSource := range config.SourcesConfig {
-		if cfgSource.URL == "" {
-			return fmt.Errorf("Missing URL for source [%s]", cfgSourceName)
-		}
-		if cfgSource.MinisignKeyStr == "" {
-			return fmt.Errorf("Missing Minisign key for source [%s]", cfgSourceName)
-		}
-		if cfgSource.CacheFile == "" {
-			return fmt.Errorf("Missing cache file for source [%s]", cfgSourceName)
-		}
-		if cfgSource.FormatStr == "" {
-			return fmt.Errorf("Missing format for source [%s]", cfgSourceName)
+	requiredProps := config.requiredServerProperties()
+
+	if err := config.applySourcesConfig(); err != nil {
+		return err
+	}
+	var serversBlacklist *ServersBlacklist
+	if len(config.ServersBlacklistFile) > 0 {
+		var err error
+		if serversBlacklist, err = LoadServersBlacklist(config.ServersBlacklistFile); err != nil {
+			return err
 		}
-		if cfgSource.RefreshDelay <= 0 {
-			cfgSource.RefreshDelay = 24
+	}
+	var serversOverrides *ServersOverrides
+	if len(config.ServersOverrideFile) > 0 {
+		var err error
+		if serversOverrides, err = LoadServersOverrides(config.ServersOverrideFile); err != nil {
+			return err
 		}
-		source, sourceUrlsToPrefetch, err := NewSource(cfgSource.URL, cfgSource.MinisignKeyStr, cfgSource.CacheFile, cfgSource.FormatStr, time.Duration(cfgSource.RefreshDelay)*time.Hour)
-		proxy.urlsToPrefetch = append(proxy.urlsToPrefetch, sourceUrlsToPrefetch...)
+	}
+	for _, result := range config.LoadSources(proxy.ctx, config.sourceNames()) {
+		cfgSourceName, cfgSource, source, err := result.name, config.SourcesConfig[result.name], result.source, result.err
+		proxy.urlsToPrefetch = append(proxy.urlsToPrefetch, result.urlsToPrefetch...)
+		proxy.sources = append(proxy.sources, &source)
 		if err != nil {
 			dlog.Criticalf("Unable use source [%s]: [%s]", cfgSourceName, err)
 			continue
 		}
 		registeredServers, err := source.Parse(cfgSource.Prefix)
+		if err == nil && len(registeredServers) > 0 {
+			if err = source.PromoteLastKnownGood(); err != nil {
+				dlog.Warnf("Unable to save the last known good version of source [%s]: %s", cfgSourceName, err)
+			}
+			err = nil
+		} else if len(source.cacheFile) > 0 && source.RollbackToLastKnownGood() == nil {
+			registeredServers, err = source.Parse(cfgSource.Prefix)
+		}
 		if err != nil {
 			dlog.Criticalf("Unable use source [%s]: [%s]", cfgSourceName, err)
 			continue
 		}
+		if serversOverrides != nil {
+			registeredServers = serversOverrides.Apply(cfgSourceName, registeredServers)
+		}
+		registeredServers = filterRegisteredServers(SourcesServerFilter, registeredServers)
+		if serversBlacklist != nil {
+			registeredServers = serversBlacklist.Filter(cfgSourceName, registeredServers)
+		}
+		if cfgSource.RequireDNSSEC {
+			registeredServers = filterRegisteredServersByProps(cfgSourceName, registeredServers, ServerInformalPropertyDNSSEC)
+		}
+		sourceRequiredProps := source.requiredProperties(requiredProps)
 		for _, registeredServer := range registeredServers {
+			if registeredServer.stamp.proto == StampProtoTypeDNSCryptRelay {
+				dlog.Debugf("Ignoring relay [%s] from resolvers source [%s]", registeredServer.name, cfgSourceName)
+				continue
+			}
 			if len(config.ServerNames) > 0 {
 				if !includesName(config.ServerNames, registeredServer.name) {
 					continue
 				}
-			} else if registeredServer.stamp.props&requiredProps != requiredProps {
+			} else if registeredServer.stamp.props&sourceRequiredProps != sourceRequiredProps {
 				continue
 			}
 			if config.SourceIPv4 || config.SourceIPv6 {
@@ -251,10 +369,21 @@ func ConfigLoad(proxy *Proxy, svcFlag *string, config_file string) error {
 					continue
 				}
 			}
-			dlog.Debugf("Adding [%s] to the set of wanted resolvers", registeredServer.name)
+			dlog.Debugf("Adding [%s] from source [%s] to the set of wanted resolvers", registeredServer.name, registeredServer.source)
+			if len(registeredServer.description) > 0 {
+				dlog.Debugf("[%s]: %s", registeredServer.name, registeredServer.description)
+			}
 			proxy.registeredServers = append(proxy.registeredServers, registeredServer)
 		}
 	}
+	if serversOverrides != nil {
+		serversOverrides.LogUnused()
+	}
+	proxy.registeredServers = removeDuplicateStamps(proxy.registeredServers)
+	sortRegisteredServers(proxy.registeredServers)
+	if config.SourcesLogProtocols && len(proxy.registeredServers) > 0 {
+		logServersProtocolsDistribution(proxy.registeredServers)
+	}
 	if len(config.ServerNames) == 0 {
 		for serverName := range config.ServersConfig {
 			config.ServerNames = append(config.ServerNames, serverName)
@@ -283,6 +412,148 @@ func ConfigLoad(proxy *Proxy, svcFlag *string, config_file string) error {
 	return nil
 }
 
+// applySourcesConfig validates the settings of the sources, and applies the
+// global ones. It has to be called before any source is loaded.
+func (config *Config) applySourcesConfig() error {
+	if _, ok := sourceTLSVersions[config.SourcesMinTLSVersion]; !ok && len(config.SourcesMinTLSVersion) > 0 {
+		return fmt.Errorf("Unsupported minimum TLS version for sources: [%s]", config.SourcesMinTLSVersion)
+	}
+	if config.SourcesJitter < 0 || config.SourcesJitter > 50 {
+		return errors.New("sources_refresh_jitter must be between 0 and 50")
+	}
+	if config.SourcesMaxFetches < 0 {
+		return errors.New("sources_max_concurrent_fetches cannot be negative")
+	}
+	SetSourcesFetchConcurrency(config.SourcesMaxFetches)
+	if len(config.SourcesSOCKSProxy) > 0 {
+		if _, _, err := net.SplitHostPort(config.SourcesSOCKSProxy); err != nil {
+			return fmt.Errorf("Invalid SOCKS5 proxy address for sources: [%s]", config.SourcesSOCKSProxy)
+		}
+		if len(config.SourcesHTTPProxy) > 0 {
+			return errors.New("sources_http_proxy and sources_socks5_proxy cannot be used together")
+		}
+	}
+	if config.SourcesMemoryCache {
+		SourcesCache = NewMemorySourceCache()
+	} else {
+		var cacheFiles []string
+		for _, cfgSource := range config.SourcesConfig {
+			if _, isLocal := localSourcePath(cfgSource.URL); !isLocal && len(cfgSource.CacheFile) > 0 {
+				cacheFiles = append(cacheFiles, cfgSource.CacheFile)
+			}
+		}
+		useMemoryCacheIfUnwritable(cacheFiles)
+	}
+	for cfgSourceName, cfgSource := range config.SourcesConfig {
+		if cfgSource.URL == "" {
+			return fmt.Errorf("Missing URL for source [%s]", cfgSourceName)
+		}
+		if cfgSource.MinisignKeyStr == "" && !cfgSource.InsecureNoSignature {
+			return fmt.Errorf("Missing Minisign key for source [%s]", cfgSourceName)
+		}
+		if _, isLocal := localSourcePath(cfgSource.URL); cfgSource.CacheFile == "" && !isLocal {
+			return fmt.Errorf("Missing cache file for source [%s]", cfgSourceName)
+		}
+		if cfgSource.FormatStr == "" {
+			return fmt.Errorf("Missing format for source [%s]", cfgSourceName)
+		}
+		if (len(cfgSource.Username) > 0) != (len(cfgSource.Password) > 0) {
+			return fmt.Errorf("Both a username and a password are required for source [%s]", cfgSourceName)
+		}
+		for _, algorithm := range cfgSource.SignatureAlgorithms {
+			if _, ok := SourceSignatureAlgorithms[algorithm]; !ok {
+				return fmt.Errorf("Unsupported signature algorithm for source [%s]: [%s]", cfgSourceName, algorithm)
+			}
+		}
+		switch cfgSource.ParseMode {
+		case "", "strict", "lenient":
+		default:
+			return fmt.Errorf("Unsupported parse mode for source [%s]: [%s]", cfgSourceName, cfgSource.ParseMode)
+		}
+		switch cfgSource.AddressFamily {
+		case "", SourceAddressFamilyBoth, SourceAddressFamilyIPv4, SourceAddressFamilyIPv6:
+		default:
+			return fmt.Errorf("Unsupported address family for source [%s]: [%s]", cfgSourceName, cfgSource.AddressFamily)
+		}
+	}
+	return nil
+}
+
+func (config *Config) newSource(ctx context.Context, name string, cfgSource *SourceConfig) (Source, []URLToPrefetch, error) {
+	fetchOptions := SourceFetchOptions{
+		headers:             cfgSource.Headers,
+		userAgent:           cfgSource.UserAgent,
+		username:            cfgSource.Username,
+		password:            cfgSource.Password,
+		resumeDownloads:     cfgSource.ResumeDownloads,
+		attempts:            cfgSource.FetchAttempts,
+		timeout:             time.Duration(cfgSource.FetchTimeout) * time.Second,
+		httpProxy:           config.SourcesHTTPProxy,
+		socksProxy:          config.SourcesSOCKSProxy,
+		minTLSVersion:       sourceTLSVersions[config.SourcesMinTLSVersion],
+		maxSize:             int64(cfgSource.MaxSize) * 1024 * 1024,
+		insecureNoSignature: cfgSource.InsecureNoSignature,
+		warnOnlySignature:   cfgSource.SignatureWarnOnly,
+		pinOnFirstUse:       cfgSource.PinOnFirstUse,
+		sigAlgorithms:       cfgSource.SignatureAlgorithms,
+		inlineSig:           strings.TrimSpace(cfgSource.InlineSignature),
+		ignoreContentType:   cfgSource.IgnoreContentType,
+		sameDomainRedirects: cfgSource.SameDomainRedirects,
+		spkiPins:            cfgSource.SPKIPins,
+		maxShrinkPercent:    cfgSource.MaxShrinkPercent,
+		bootstrapResolver:   config.SourcesResolver,
+		staleCacheExpiry:    time.Duration(cfgSource.StaleCacheExpiry) * 24 * time.Hour,
+		compressCache:       config.SourcesCompressCache,
+		offline:             config.SourcesOffline,
+		jitterPercent:       config.SourcesJitter,
+		jitterSeed:          config.SourcesJitterSeed,
+		idleConnTimeout:     time.Duration(config.SourcesIdleTimeout) * time.Second,
+		negativeCacheTTL:    time.Duration(config.SourcesNegativeTTL) * time.Minute,
+		stampTransformer:    SourcesStampTransformer,
+		name:                name,
+		lenient:             cfgSource.ParseMode == "lenient",
+		allowPrivate:        cfgSource.AllowPrivateAddrs,
+		addressFamily:       cfgSource.AddressFamily,
+		resolveHosts:        cfgSource.ResolveHostnames,
+		formatFallback:      cfgSource.FormatFallback,
+	}
+	if fetchOptions.attempts <= 0 {
+		fetchOptions.attempts = DefaultSourceFetchAttempts
+	}
+	return NewSource(ctx, cfgSource.URL, cfgSource.Mirrors, cfgSource.MinisignKeyStr, cfgSource.CacheFile, cfgSource.FormatStr, config.sourceRefreshDelay(cfgSource), fetchOptions)
+}
+
+// requiredServerProperties returns the properties that servers from sources
+// must have, according to the require_* settings.
+func (config *Config) requiredServerProperties() ServerInformalProperties {
+	requiredProps := ServerInformalProperties(0)
+	if config.SourceRequireDNSSEC {
+		requiredProps |= ServerInformalPropertyDNSSEC
+	}
+	if config.SourceRequireNoLog {
+		requiredProps |= ServerInformalPropertyNoLog
+	}
+	if config.SourceRequireNoFilter {
+		requiredProps |= ServerInformalPropertyNoFilter
+	}
+	return requiredProps
+}
+
+func (config *Config) sourceRefreshDelay(cfgSource *SourceConfig) time.Duration {
+	if cfgSource.RefreshDelay > 0 {
+		return time.Duration(cfgSource.RefreshDelay) * time.Hour
+	}
+	if refreshDelay, ok := config.SourcesRefreshDelay[cfgSource.FormatStr]; ok && refreshDelay > 0 {
+		return time.Duration(refreshDelay) * time.Hour
+	}
+	if format, err := sourceFormatFromString(cfgSource.FormatStr); err == nil {
+		if refreshDelay, ok := DefaultSourcesRefreshDelays[format]; ok {
+			return refreshDelay
+		}
+	}
+	return SourcesUpdateDelay
+}
+
 func includesName(names []string, name string) bool {
 	for _, found := range names {
 		if strings.EqualFold(found, name) {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaToASCII converts an internationalized host name, optionally followed by
+// a port, to its ASCII form, after applying the IDNA mapping and
+// normalization rules for lookups. ASCII names are returned as they are.
+func idnaToASCII(hostname string) (string, error) {
+	if isASCII(hostname) {
+		return hostname, nil
+	}
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host, port = hostname, ""
+	}
+	if host, err = idna.Lookup.ToASCII(host); err != nil {
+		return hostname, err
+	}
+	if len(port) == 0 {
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeServerAddr decodes percent-encoded characters in the host part of
+// addr and converts internationalized host names to their ASCII form.
+func normalizeServerAddr(addr string) (string, error) {
+	if net.ParseIP(addr) != nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	if strings.HasPrefix(host, "[") || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	if host, err = url.PathUnescape(host); err != nil {
+		return addr, err
+	}
+	if host, err = idnaToASCII(host); err != nil {
+		return addr, err
+	}
+	if len(port) == 0 {
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func isASCII(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
@@ -54,6 +55,9 @@ type Proxy struct {
 	forwardFile                  string
 	pluginsGlobals               PluginsGlobals
 	urlsToPrefetch               []URLToPrefetch
+	sources                      []*Source
+	ctx                          context.Context
+	cancel                       context.CancelFunc
 	clientsCount                 uint32
 	maxClients                   uint32
 	httpTransport                *http.Transport
@@ -142,6 +146,9 @@ func (app *App) AppMain(proxy *Proxy) {
 }
 
 func (app *App) Stop(service service.Service) error {
+	if app.proxy.cancel != nil {
+		app.proxy.cancel()
+	}
 	dlog.Notice("Stopped.")
 	return nil
 }
@@ -191,7 +198,7 @@ func (proxy *Proxy) StartProxy() {
 		dlog.Error(err)
 		dlog.Notice("dnscrypt-proxy is waiting for at least one server to be reachable")
 	}
-	proxy.prefetcher(&proxy.urlsToPrefetch)
+	go PrefetchQueue(proxy.urlsToPrefetch).Prefetch(proxy.ctx)
 	go func() {
 		for {
 			delay := proxy.certRefreshDelay
@@ -204,26 +211,6 @@ func (proxy *Proxy) StartProxy() {
 	}()
 }
 
-func (proxy *Proxy) prefetcher(urlsToPrefetch *[]URLToPrefetch) {
-	go func() {
-		for {
-			now := time.Now()
-			for i := range *urlsToPrefetch {
-				urlToPrefetch := &(*urlsToPrefetch)[i]
-				if now.After(urlToPrefetch.when) {
-					dlog.Debugf("Prefetching [%s]", urlToPrefetch.url)
-					if err := PrefetchSourceURL(urlToPrefetch); err != nil {
-						dlog.Debugf("Prefetching [%s] failed: %s", err)
-					} else {
-						dlog.Debugf("Prefetching [%s] succeeded. Next refresh scheduled for %v", urlToPrefetch.url, urlToPrefetch.when)
-					}
-				}
-			}
-			time.Sleep(60 * time.Second)
-		}
-	}()
-}
-
 func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
 	defer clientPc.Close()
 	for {
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,11 +29,95 @@ const (
 type ServerInformalProperties uint64
 
 const (
-	ServerInformalPropertyDNSSEC = ServerInformalProperties(1) << 0
-	ServerInformalPropertyNoLog  = ServerInformalProperties(1) << 1
+	ServerInformalPropertyDNSSEC   = ServerInformalProperties(1) << 0
+	ServerInformalPropertyNoLog    = ServerInformalProperties(1) << 1
+	ServerInformalPropertyNoFilter = ServerInformalProperties(1) << 2
 )
 
 type RegisteredServer struct {
+	name        string
+	stamp       ServerStamp
+	description string
+	source      string
+	stamps      []ServerStamp
+	proto       StampProtoType
+	host        string
+	port        int
+	relayHints  []RelayHint
+}
+
+// RelayHint is a relay recommended by the description of a server, for
+// anonymized DNSCrypt: either a relay stamp, or the name of a relay.
+type RelayHint struct {
+	Stamp string
+	Name  string
+}
+
+// RelayHints returns the relays suggested by the description of the server.
+func (registeredServer *RegisteredServer) RelayHints() []RelayHint {
+	return registeredServer.relayHints
+}
+
+// decodeStamp caches the protocol and the address of the stamp, so that
+// callers don't have to decode it again to filter servers.
+func (registeredServer *RegisteredServer) decodeStamp() {
+	stamp := &registeredServer.stamp
+	registeredServer.proto = stamp.proto
+	addr := stamp.serverAddrStr
+	if len(addr) == 0 && stamp.proto == StampProtoTypeDoH {
+		addr = stamp.providerName
+	}
+	registeredServer.host, registeredServer.port = addr, DefaultPort
+	if host, portStr, err := net.SplitHostPort(addr); err == nil {
+		registeredServer.host = host
+		if port, err := strconv.Atoi(portStr); err == nil {
+			registeredServer.port = port
+		}
+	} else {
+		registeredServer.host = strings.Trim(addr, "[]")
+	}
+}
+
+// ServerDescriptor describes a registered server, for status commands and
+// admin interfaces.
+type ServerDescriptor struct {
+	Name        string `json:"name"`
+	Source      string `json:"source,omitempty"`
+	Protocol    string `json:"protocol"`
+	Address     string `json:"address"`
+	Port        int    `json:"port"`
+	DNSSEC      bool   `json:"dnssec"`
+	NoLog       bool   `json:"nolog"`
+	NoFilter    bool   `json:"nofilter"`
+	Description string `json:"description,omitempty"`
+	Stamp       string `json:"stamp"`
+}
+
+// ListServers returns the servers registered by the sources and the static
+// server definitions. The list is built once at startup and never modified
+// afterwards, so this doesn't need any locking.
+func (proxy *Proxy) ListServers() []ServerDescriptor {
+	descriptors := make([]ServerDescriptor, 0, len(proxy.registeredServers))
+	for _, registeredServer := range proxy.registeredServers {
+		registeredServer.decodeStamp()
+		props := registeredServer.stamp.props
+		descriptors = append(descriptors, ServerDescriptor{
+			Name:        registeredServer.name,
+			Source:      registeredServer.source,
+			Protocol:    registeredServer.proto.String(),
+			Address:     registeredServer.host,
+			Port:        registeredServer.port,
+			DNSSEC:      props&ServerInformalPropertyDNSSEC != 0,
+			NoLog:       props&ServerInformalPropertyNoLog != 0,
+			NoFilter:    props&ServerInformalPropertyNoFilter != 0,
+			Description: registeredServer.description,
+			Stamp:       registeredServer.stamp.String(),
+		})
+	}
+	return descriptors
+}
+
+type RegisteredRelay struct {
 	name  string
 	stamp ServerStamp
 }
@@ -1,20 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	"github.com/dchest/safefile"
+	"github.com/dsnet/compress/brotli"
 
 	"github.com/jedisct1/dlog"
 	"github.com/jedisct1/go-minisign"
+	"golang.org/x/crypto/ed25519"
 )
 
 type SourceFormat int
@@ -22,34 +44,187 @@ type SourceFormat int
 const (
 	SourceFormatV1 = iota
 	SourceFormatV2
+	SourceFormatV3
 )
 
 const (
-	SourcesUpdateDelay = time.Duration(24) * time.Hour
+	SourcesUpdateDelay    = time.Duration(24) * time.Hour
+	MinSourcesUpdateDelay = time.Duration(1) * time.Minute
 )
 
+const (
+	DefaultSourceFetchAttempts = 3
+	SourceFetchInitialBackoff  = time.Duration(1) * time.Second
+	DefaultSourceFetchTimeout  = time.Duration(30) * time.Second
+	DefaultSourceUserAgent     = "dnscrypt-proxy/" + AppVersion
+	DefaultSourceMinTLSVersion = uint16(tls.VersionTLS12)
+)
+
+// A URL that cannot be refreshed is retried after SourcePrefetchMinBackoff,
+// then after twice as long after every consecutive failure, up to
+// SourcePrefetchMaxBackoff or the refresh delay, whichever is shorter.
+const (
+	SourcePrefetchMinBackoff = time.Duration(5) * time.Minute
+	SourcePrefetchMaxBackoff = time.Duration(6) * time.Hour
+)
+
+func prefetchBackoff(failures int, refreshDelay time.Duration) time.Duration {
+	maxBackoff := SourcePrefetchMaxBackoff
+	if refreshDelay > 0 && refreshDelay < maxBackoff {
+		maxBackoff = refreshDelay
+	}
+	backoff := SourcePrefetchMinBackoff
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+var sourceTLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsVersionName(version uint16) string {
+	for name, v := range sourceTLSVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+const (
+	DefaultSourceMaxSize = 20 * 1024 * 1024
+	SourceSigMaxSize     = 64 * 1024
+)
+
+const MaxConcurrentSourceLoads = 4
+
+const MaxSourceRedirects = 5
+
+const StdinSourceURL = "-"
+
+const MemorySourceURLPrefix = "memory://"
+
+const SourceLastKnownGoodSuffix = ".good"
+
+var StdinSourceSigFile string
+
+var DefaultSourcesRefreshDelays = map[SourceFormat]time.Duration{
+	SourceFormatV1: time.Duration(168) * time.Hour,
+	SourceFormatV2: time.Duration(24) * time.Hour,
+	SourceFormatV3: time.Duration(24) * time.Hour,
+}
+
+func sourceFormatFromString(formatStr string) (SourceFormat, error) {
+	switch formatStr {
+	case "v1":
+		return SourceFormatV1, nil
+	case "v2":
+		return SourceFormatV2, nil
+	case "v3":
+		return SourceFormatV3, nil
+	}
+	return SourceFormatV1, fmt.Errorf("Unsupported source format: [%s]", formatStr)
+}
+
+// StampTransformer can rewrite the stamp of a server parsed from a source.
+// Returning false drops the server.
+type StampTransformer func(name string, stamp ServerStamp) (ServerStamp, bool)
+
+// SourcesStampTransformer, if set, is applied to the stamps of all sources
+var SourcesStampTransformer StampTransformer
+
+// ServerFilter is called for every server parsed from a source before it is
+// registered. It can modify the server, and drops it by returning false.
+type ServerFilter func(registeredServer *RegisteredServer) bool
+
+// SourcesServerFilter, if set, is applied to the servers of all sources
+var SourcesServerFilter ServerFilter
+
+func filterRegisteredServers(filter ServerFilter, registeredServers []RegisteredServer) []RegisteredServer {
+	if filter == nil {
+		return registeredServers
+	}
+	var filteredServers []RegisteredServer
+	for _, registeredServer := range registeredServers {
+		if !filter(&registeredServer) {
+			dlog.Debugf("Server [%s] from source [%s] removed by the server filter", registeredServer.name, registeredServer.source)
+			continue
+		}
+		filteredServers = append(filteredServers, registeredServer)
+	}
+	return filteredServers
+}
+
 type Source struct {
-	url    string
-	format SourceFormat
-	in     string
+	url              string
+	mirrors          []string
+	format           SourceFormat
+	in               string
+	minisignKeys     []minisign.PublicKey
+	cacheFile        string
+	sigCacheFile     string
+	refreshDelay     time.Duration
+	when             time.Time
+	autoFormat       bool
+	formatFallback   bool
+	stampTransformer StampTransformer
+	serial           string
+	timestamp        int64
+	lenient          bool
+	allowPrivate     bool
+	addressFamily    string
+	resolveHosts     bool
+	fetchOptions     SourceFetchOptions
+	name             string
+	lastUpdate       time.Time
+	serverCount      int
+	fetchFailures    uint64
+	cacheHits        uint64
+	dataTime         time.Time
+	stale            bool
+	warnings         []string
 }
 
-func fetchFromCache(cacheFile string) (in string, delayTillNextUpdate time.Duration, err error) {
-	fi, err := os.Stat(cacheFile)
+// SourcesNow returns the current time for everything related to sources:
+// cache freshness, refresh schedules and memory cache entries. It can be
+// replaced to control time without waiting.
+var SourcesNow = time.Now
+
+func fetchFromCache(cacheFile string, refreshDelay time.Duration) (in string, modTime time.Time, delayTillNextUpdate time.Duration, err error) {
+	modTime, err = SourcesCache.ModTime(cacheFile)
 	if err != nil {
 		delayTillNextUpdate = time.Duration(0)
 		return
 	}
-	elapsed := time.Since(fi.ModTime())
-	if elapsed < SourcesUpdateDelay {
+	elapsed := SourcesNow().Sub(modTime)
+	if elapsed < 0 {
+		dlog.Warnf("Cache file [%s] was modified in the future (%v) - the system clock may be wrong, refreshing it", cacheFile, modTime)
+		delayTillNextUpdate = time.Duration(0)
+	} else if expiry, ok := loadCacheExpiry(cacheFile); ok {
+		if remaining := expiry.Sub(SourcesNow()); remaining > 0 {
+			dlog.Debugf("Cache file [%s] is still fresh according to the server", cacheFile)
+			delayTillNextUpdate = remaining
+		} else {
+			dlog.Debugf("Cache file [%s] has expired according to the server", cacheFile)
+			delayTillNextUpdate = time.Duration(0)
+		}
+	} else if elapsed < refreshDelay {
 		dlog.Debugf("Cache file [%s] is still fresh", cacheFile)
-		delayTillNextUpdate = SourcesUpdateDelay - elapsed
+		delayTillNextUpdate = refreshDelay - elapsed
 	} else {
 		dlog.Debugf("Cache file [%s] needs to be refreshed", cacheFile)
 		delayTillNextUpdate = time.Duration(0)
 	}
 	var bin []byte
-	bin, err = ioutil.ReadFile(cacheFile)
+	bin, err = readCachedSource(cacheFile)
 	if err != nil {
 		delayTillNextUpdate = time.Duration(0)
 		return
@@ -58,206 +233,3299 @@ func fetchFromCache(cacheFile string) (in string, delayTillNextUpdate time.Durat
 	return
 }
 
-func fetchWithCache(url string, cacheFile string) (in string, cached bool, delayTillNextUpdate time.Duration, err error) {
-	cached = false
-	in, delayTillNextUpdate, err = fetchFromCache(cacheFile)
-	if err == nil {
-		dlog.Debugf("Delay till next update: %v", delayTillNextUpdate)
-		cached = true
+// DefaultSourceFetchConcurrency is the maximum number of sources and
+// signatures downloaded at the same time, across all the sources.
+const DefaultSourceFetchConcurrency = 4
+
+var (
+	sourcesFetchSlotsLock sync.Mutex
+	sourcesFetchSlots     = make(chan struct{}, DefaultSourceFetchConcurrency)
+)
+
+// SetSourcesFetchConcurrency changes the maximum number of concurrent
+// downloads. Downloads in progress are not affected.
+func SetSourcesFetchConcurrency(max int) {
+	if max < 1 {
+		max = DefaultSourceFetchConcurrency
+	}
+	sourcesFetchSlotsLock.Lock()
+	sourcesFetchSlots = make(chan struct{}, max)
+	sourcesFetchSlotsLock.Unlock()
+}
+
+// acquireFetchSlot waits until fewer than the maximum number of downloads
+// are in progress. Extra downloads are queued, and only fail if the
+// context is done while they are waiting.
+func acquireFetchSlot(ctx context.Context, url string) (release func(), err error) {
+	sourcesFetchSlotsLock.Lock()
+	slots := sourcesFetchSlots
+	sourcesFetchSlotsLock.Unlock()
+	select {
+	case slots <- struct{}{}:
+	default:
+		dlog.Debugf("Too many downloads in progress - [%s] is queued", url)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-slots }, nil
+}
+
+func fetchWithCache(ctx context.Context, url string, cacheFile string, refreshDelay time.Duration, fetchOptions *SourceFetchOptions) (in string, cached bool, stale bool, delayTillNextUpdate time.Duration, err error) {
+	cached, stale = false, false
+	if isStdinSourceURL(url) {
+		in, err = fetchFromStdin(url)
+		delayTillNextUpdate = refreshDelay
 		return
 	}
-	var resp *http.Response
-	dlog.Infof("Loading source information from URL [%s]", url)
-	resp, err = http.Get(url)
-	if err == nil && resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
-		err = fmt.Errorf("Webserver returned code %d", resp.StatusCode)
+	if path, ok := localSourcePath(url); ok {
+		in, err = fetchFromFile(path)
+		delayTillNextUpdate = refreshDelay
 		return
-	} else if err != nil {
+	}
+	// The jitter moves the time at which the cache is considered stale, so
+	// that the download actually happens when the refresh is scheduled
+	refreshDelay = fetchOptions.jitter(refreshDelay)
+	var modTime time.Time
+	in, modTime, delayTillNextUpdate, err = fetchFromCache(cacheFile, refreshDelay)
+	if fetchOptions != nil && fetchOptions.offline {
+		if err != nil {
+			err = fmt.Errorf("Offline mode - no cached copy of [%s]", url)
+			return
+		}
+		dlog.Debugf("Offline mode - using the cached copy of [%s] from %v", url, modTime)
+		cached, delayTillNextUpdate = true, refreshDelay
 		return
-	} else if resp == nil {
-		err = errors.New("Webserver returned an error")
+	}
+	if err == nil && delayTillNextUpdate > 0 {
+		dlog.Debugf("Delay till next update: %v", delayTillNextUpdate)
+		cached = true
+		SourcesMetrics.CacheHit(url)
 		return
 	}
-	var bin []byte
-	bin, err = ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	staleIn, hasStale := in, err == nil
+	validators := cacheValidators{}
+	if hasStale {
+		validators = loadCacheValidators(cacheFile)
+		if len(validators.lastModified) == 0 {
+			validators.lastModified = modTime.UTC().Format(http.TimeFormat)
+		}
+	}
+	var resp httpFetchResponse
+	partFile := ""
+	if fetchOptions != nil && fetchOptions.resumeDownloads && len(cacheFile) > 0 {
+		partFile = cacheFile + ".part"
+	}
+	negativeCacheHit := false
+	if status, remaining, ok := loadNegativeCache(cacheFile, url); ok {
+		negativeCacheHit = true
+		dlog.Debugf("Not downloading [%s] - it returned HTTP %d, retrying in %v", url, status, remaining)
+		err = fmt.Errorf("HTTP %d for [%s] (not retried before %v)", status, url, remaining)
+		resp.statusCode, resp.retryAfter = status, remaining
+	} else {
+		resp, err = fetchHTTP(ctx, url, false, fetchOptions, &validators, partFile)
+		if err != nil && isNonTransientHTTPStatus(resp.statusCode) {
+			storeNegativeCache(cacheFile, url, resp.statusCode, fetchOptions)
+		}
+	}
 	if err != nil {
+		// No requests were sent if the URL is in the negative cache
+		if !negativeCacheHit {
+			SourcesMetrics.FetchFailed(url, resp.statusCode)
+		}
+		if resp.retryAfter > 0 {
+			delayTillNextUpdate = resp.retryAfter
+		}
+		if hasStale && fetchOptions != nil && fetchOptions.staleCacheExpiry > 0 && SourcesNow().Sub(modTime) > fetchOptions.staleCacheExpiry {
+			dlog.Warnf("Unable to refresh [%s] (%s), and the cache file is too old to be used (%v)", url, err, modTime)
+			hasStale = false
+		}
+		if hasStale {
+			dlog.Noticef("Unable to refresh [%s] (%s) - using the stale cache file", url, err)
+			in, cached, stale, err = staleIn, true, true, nil
+			SourcesMetrics.StaleCacheUsed(url)
+		}
 		return
 	}
-	err = nil
-	in = string(bin)
-	delayTillNextUpdate = SourcesUpdateDelay
+	SourcesMetrics.FetchSucceeded(url)
+	if len(cacheFile) > 0 {
+		clearNegativeCache(cacheFile, url)
+	}
+	delayTillNextUpdate = refreshDelay
+	if resp.hasMaxAge {
+		delayTillNextUpdate = resp.maxAge
+		storeCacheExpiry(cacheFile, SourcesNow().Add(resp.maxAge))
+	} else {
+		SourcesCache.Remove(cacheFile + ".ttl")
+	}
+	if resp.notModified {
+		dlog.Debugf("[%s] has not been modified", url)
+		SourcesCache.Touch(cacheFile)
+		in, cached = staleIn, true
+		return
+	}
+	storeCacheValidators(cacheFile, resp.validators)
+	in = resp.in
 	return
 }
 
-func AtomicFileWrite(file string, data []byte) error {
-	return safefile.WriteFile(file, data, 0644)
+// The SHA-256 hash of the content of a cache file is stored next to it, to
+// detect updates without reading the previous content again.
+const SourceContentHashSuffix = ".sha256"
+
+func contentHash(in string) string {
+	hash := sha256.Sum256([]byte(in))
+	return hex.EncodeToString(hash[:])
 }
 
-type URLToPrefetch struct {
-	url       string
-	cacheFile string
-	when      time.Time
-}
-
-func NewSource(url string, minisignKeyStr string, cacheFile string, formatStr string, refreshDelay time.Duration) (Source, []URLToPrefetch, error) {
-	_ = refreshDelay
-	source := Source{url: url}
-	if formatStr == "v1" {
-		source.format = SourceFormatV1
-	} else if formatStr == "v2" {
-		source.format = SourceFormatV2
-	} else {
-		return source, []URLToPrefetch{}, fmt.Errorf("Unsupported source format: [%s]", formatStr)
+func storeContentHash(cacheFile string, in string) {
+	if err := SourcesCache.Write(cacheFile+SourceContentHashSuffix, []byte(contentHash(in))); err != nil {
+		dlog.Debugf("%s: %s", cacheFile, err)
+	}
+}
+
+// contentChanged returns true if in differs from the content of cacheFile.
+// Cache files without a stored hash are read and hashed.
+func contentChanged(cacheFile string, in string) bool {
+	if hash, err := SourcesCache.Read(cacheFile + SourceContentHashSuffix); err == nil {
+		return strings.TrimFunc(string(hash), unicode.IsSpace) != contentHash(in)
 	}
-	minisignKey, err := minisign.NewPublicKey(minisignKeyStr)
+	cachedIn, err := readCachedSource(cacheFile)
 	if err != nil {
-		return source, []URLToPrefetch{}, err
+		return true
 	}
-	now := time.Now()
-	urlsToPrefetch := []URLToPrefetch{}
+	return string(cachedIn) != in
+}
 
-	sigURL := url + ".minisig"
-	in, cached, delayTillNextUpdate, err := fetchWithCache(url, cacheFile)
-	urlsToPrefetch = append(urlsToPrefetch, URLToPrefetch{url: url, cacheFile: cacheFile, when: now.Add(delayTillNextUpdate)})
+// Client errors such as 404 are remembered next to the cache file for
+// DefaultSourceNegativeCacheTTL, so that sources that are gone are not
+// downloaded again and again. The file has one "<expiry> <status> <url>" line
+// per URL, so that an error from a URL doesn't prevent the mirrors sharing
+// the same cache file from being tried.
+const (
+	SourceNegativeCacheSuffix     = ".backoff"
+	DefaultSourceNegativeCacheTTL = time.Duration(1) * time.Hour
+)
 
-	sigCacheFile := cacheFile + ".minisig"
-	sigStr, sigCached, sigDelayTillNextUpdate, sigErr := fetchWithCache(sigURL, sigCacheFile)
-	urlsToPrefetch = append(urlsToPrefetch, URLToPrefetch{url: sigURL, cacheFile: sigCacheFile, when: now.Add(sigDelayTillNextUpdate)})
+// isNonTransientHTTPStatus returns true for client errors that retrying
+// isn't going to fix. Timeouts and rate limiting are transient.
+func isNonTransientHTTPStatus(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
 
-	if err != nil || sigErr != nil {
-		if err == nil {
-			err = sigErr
+type negativeCacheEntry struct {
+	url    string
+	status int
+	expiry time.Time
+}
+
+func loadNegativeCacheEntries(cacheFile string) []negativeCacheEntry {
+	bin, err := SourcesCache.Read(cacheFile + SourceNegativeCacheSuffix)
+	if err != nil {
+		return nil
+	}
+	var entries []negativeCacheEntry
+	for _, line := range strings.Split(string(bin), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
 		}
-		return source, urlsToPrefetch, err
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		status, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, negativeCacheEntry{url: fields[2], status: status, expiry: time.Unix(expiry, 0)})
 	}
+	return entries
+}
 
-	signature, err := minisign.DecodeSignature(sigStr)
-	if err != nil {
-		os.Remove(cacheFile)
-		os.Remove(sigCacheFile)
-		return source, urlsToPrefetch, err
+// storeNegativeCacheEntries writes the entries that haven't expired yet, and
+// removes the file if there are none left.
+func storeNegativeCacheEntries(cacheFile string, entries []negativeCacheEntry) {
+	var buf bytes.Buffer
+	now := SourcesNow()
+	for _, entry := range entries {
+		if entry.expiry.After(now) {
+			fmt.Fprintf(&buf, "%d %d %s\n", entry.expiry.Unix(), entry.status, entry.url)
+		}
 	}
-	res, err := minisignKey.Verify([]byte(in), signature)
-	if err != nil || !res {
-		os.Remove(cacheFile)
-		os.Remove(sigCacheFile)
-		return source, urlsToPrefetch, err
+	if buf.Len() == 0 {
+		SourcesCache.Remove(cacheFile + SourceNegativeCacheSuffix)
+		return
+	}
+	if err := SourcesCache.Write(cacheFile+SourceNegativeCacheSuffix, buf.Bytes()); err != nil {
+		dlog.Debugf("%s: %s", cacheFile, err)
+	}
+}
+
+func loadNegativeCache(cacheFile string, url string) (status int, remaining time.Duration, ok bool) {
+	if len(cacheFile) == 0 {
+		return
 	}
-	if !cached {
-		if err = AtomicFileWrite(cacheFile, []byte(in)); err != nil {
-			dlog.Warnf("%s: %s", cacheFile, err)
+	for _, entry := range loadNegativeCacheEntries(cacheFile) {
+		if entry.url == url {
+			remaining = entry.expiry.Sub(SourcesNow())
+			return entry.status, remaining, remaining > 0
 		}
 	}
-	if !sigCached {
-		if err = AtomicFileWrite(sigCacheFile, []byte(sigStr)); err != nil {
-			dlog.Warnf("%s: %s", sigCacheFile, err)
+	return
+}
+
+// clearNegativeCache forgets the error previously returned by url. The file
+// is only rewritten if it had an entry for it.
+func clearNegativeCache(cacheFile string, url string) {
+	entries := loadNegativeCacheEntries(cacheFile)
+	for i, entry := range entries {
+		if entry.url == url {
+			storeNegativeCacheEntries(cacheFile, append(entries[:i:i], entries[i+1:]...))
+			return
 		}
 	}
-	dlog.Noticef("Source [%s] loaded", url)
-	source.in = in
-	return source, urlsToPrefetch, nil
 }
 
-func (source *Source) Parse(prefix string) ([]RegisteredServer, error) {
-	if source.format == SourceFormatV1 {
-		return source.parseV1(prefix)
-	} else if source.format == SourceFormatV2 {
-		return source.parseV2(prefix)
+func storeNegativeCache(cacheFile string, url string, status int, fetchOptions *SourceFetchOptions) {
+	ttl := DefaultSourceNegativeCacheTTL
+	if fetchOptions != nil && fetchOptions.negativeCacheTTL != 0 {
+		ttl = fetchOptions.negativeCacheTTL
 	}
-	dlog.Fatal("Unexpected source format")
-	return []RegisteredServer{}, nil
+	if len(cacheFile) == 0 || ttl < 0 {
+		return
+	}
+	if status == http.StatusNotFound || status == http.StatusGone {
+		dlog.Warnf("[%s] is gone (HTTP %d) - the source should probably be removed from the configuration. Not retrying before %v", url, status, ttl)
+	} else {
+		dlog.Warnf("[%s] was refused (HTTP %d) - not retrying before %v", url, status, ttl)
+	}
+	entries := []negativeCacheEntry{{url: url, status: status, expiry: SourcesNow().Add(ttl)}}
+	for _, entry := range loadNegativeCacheEntries(cacheFile) {
+		if entry.url != url {
+			entries = append(entries, entry)
+		}
+	}
+	storeNegativeCacheEntries(cacheFile, entries)
 }
 
-func (source *Source) parseV1(prefix string) ([]RegisteredServer, error) {
-	var registeredServers []RegisteredServer
+type cacheValidators struct {
+	etag         string
+	lastModified string
+}
 
-	csvReader := csv.NewReader(strings.NewReader(source.in))
-	records, err := csvReader.ReadAll()
+func loadCacheValidators(cacheFile string) cacheValidators {
+	var validators cacheValidators
+	bin, err := SourcesCache.Read(cacheFile + ".etag")
 	if err != nil {
-		return registeredServers, nil
+		return validators
 	}
-	for lineNo, record := range records {
-		if len(record) == 0 {
-			continue
-		}
-		if len(record) < 14 {
-			return registeredServers, fmt.Errorf("Parse error at line %d", 1+lineNo)
-		}
-		if lineNo == 0 {
-			continue
-		}
-		name := prefix + record[0]
-		serverAddrStr := record[10]
-		providerName := record[11]
-		serverPkStr := record[12]
-		props := ServerInformalProperties(0)
-		if strings.EqualFold(record[7], "yes") {
-			props |= ServerInformalPropertyDNSSEC
-		}
-		if strings.EqualFold(record[8], "yes") {
-			props |= ServerInformalPropertyNoLog
-		}
-		stamp, err := NewDNSCryptServerStampFromLegacy(serverAddrStr, serverPkStr, providerName, props)
-		if err != nil {
-			return registeredServers, err
-		}
-		registeredServer := RegisteredServer{
-			name: name, stamp: stamp,
-		}
-		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
-		registeredServers = append(registeredServers, registeredServer)
+	lines := strings.Split(string(bin), "\n")
+	validators.etag = strings.TrimFunc(lines[0], unicode.IsSpace)
+	if len(lines) > 1 {
+		validators.lastModified = strings.TrimFunc(lines[1], unicode.IsSpace)
 	}
-	return registeredServers, nil
+	return validators
 }
 
-func (source *Source) parseV2(prefix string) ([]RegisteredServer, error) {
-	var registeredServers []RegisteredServer
-	in := string(source.in)
-	parts := strings.Split(in, "## ")
-	if len(parts) < 2 {
-		return registeredServers, fmt.Errorf("Invalid format for source at [%s]", source.url)
-	}
-	parts = parts[1:]
-	for _, part := range parts {
-		part = strings.TrimFunc(part, unicode.IsSpace)
-		subparts := strings.Split(part, "\n")
-		if len(subparts) < 2 {
-			return registeredServers, fmt.Errorf("Invalid format for source at [%s]", source.url)
-		}
-		name := strings.TrimFunc(subparts[0], unicode.IsSpace)
-		if len(name) == 0 {
-			return registeredServers, fmt.Errorf("Invalid format for source at [%s]", source.url)
+func storeCacheValidators(cacheFile string, validators cacheValidators) {
+	validatorsFile := cacheFile + ".etag"
+	if len(validators.etag) == 0 && len(validators.lastModified) == 0 {
+		SourcesCache.Remove(validatorsFile)
+		return
+	}
+	if err := SourcesCache.Write(validatorsFile, []byte(validators.etag+"\n"+validators.lastModified+"\n")); err != nil {
+		dlog.Warnf("%s: %s", validatorsFile, err)
+	}
+}
+
+func loadCacheExpiry(cacheFile string) (time.Time, bool) {
+	bin, err := SourcesCache.Read(cacheFile + ".ttl")
+	if err != nil {
+		return time.Time{}, false
+	}
+	ts, err := strconv.ParseInt(strings.TrimFunc(string(bin), unicode.IsSpace), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(ts, 0), true
+}
+
+func storeCacheExpiry(cacheFile string, expiry time.Time) {
+	expiryFile := cacheFile + ".ttl"
+	if err := SourcesCache.Write(expiryFile, []byte(strconv.FormatInt(expiry.Unix(), 10))); err != nil {
+		dlog.Warnf("%s: %s", expiryFile, err)
+	}
+}
+
+func parseCacheMaxAge(header http.Header) (time.Duration, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimFunc(directive, unicode.IsSpace))
+		if directive == "no-cache" || directive == "no-store" {
+			return time.Duration(0), false
 		}
-		var stampStr string
-		for _, subpart := range subparts {
-			subpart = strings.TrimFunc(subpart, unicode.IsSpace)
-			if strings.HasPrefix(subpart, "sdns://") {
-				stampStr = subpart
-				break
+		if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.ParseUint(directive[8:], 10, 32); err == nil {
+				return time.Duration(seconds) * time.Second, true
 			}
 		}
-		if len(stampStr) < 8 {
-			return registeredServers, fmt.Errorf("Missing stamp for server [%s] in source from [%s]", name, source.url)
-		}
-		stamp, err := NewServerStampFromString(stampStr)
-		if err != nil {
-			return registeredServers, err
+	}
+	if expiresStr := header.Get("Expires"); len(expiresStr) > 0 {
+		if expires, err := http.ParseTime(expiresStr); err == nil {
+			if maxAge := expires.Sub(SourcesNow()); maxAge > 0 {
+				return maxAge, true
+			}
 		}
-		registeredServer := RegisteredServer{
-			name: name, stamp: stamp,
+	}
+	return time.Duration(0), false
+}
+
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	retryAfterStr := strings.TrimFunc(header.Get("Retry-After"), unicode.IsSpace)
+	if len(retryAfterStr) == 0 {
+		return time.Duration(0), false
+	}
+	if seconds, err := strconv.ParseUint(retryAfterStr, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, seconds > 0
+	}
+	if retryAt, err := http.ParseTime(retryAfterStr); err == nil {
+		if retryAfter := retryAt.Sub(SourcesNow()); retryAfter > 0 {
+			return retryAfter, true
 		}
-		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
-		registeredServers = append(registeredServers, registeredServer)
 	}
-	return registeredServers, nil
+	return time.Duration(0), false
+}
+
+// registrableDomain approximates the registrable domain of a host name with
+// its last two labels, as no public suffix list is available.
+func registrableDomain(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+func isStdinSourceURL(url string) bool {
+	return url == StdinSourceURL || url == StdinSourceURL+".minisig"
+}
+
+func fetchFromStdin(url string) (string, error) {
+	var bin []byte
+	var err error
+	if url == StdinSourceURL {
+		dlog.Info("Loading source information from the standard input")
+		bin, err = ioutil.ReadAll(os.Stdin)
+	} else if len(StdinSourceSigFile) == 0 {
+		err = errors.New("A signature file is required to load a source from the standard input")
+	} else {
+		bin, err = ioutil.ReadFile(StdinSourceSigFile)
+	}
+	return string(bin), err
+}
+
+type httpFetchResponse struct {
+	in          string
+	notModified bool
+	validators  cacheValidators
+	maxAge      time.Duration
+	hasMaxAge   bool
+	statusCode  int
+	retryAfter  time.Duration
+}
+
+// SourceMetrics receives the outcome of source downloads, so that embedders
+// can export them. statusCode is 0 if no HTTP response was received.
+type SourceMetrics interface {
+	FetchSucceeded(url string)
+	FetchFailed(url string, statusCode int)
+	CacheHit(url string)
+	StaleCacheUsed(url string)
+	SignatureVerificationFailed(url string)
+}
+
+type noSourceMetrics struct{}
+
+func (noSourceMetrics) FetchSucceeded(url string)              {}
+func (noSourceMetrics) FetchFailed(url string, statusCode int) {}
+func (noSourceMetrics) CacheHit(url string)                    {}
+func (noSourceMetrics) StaleCacheUsed(url string)              {}
+func (noSourceMetrics) SignatureVerificationFailed(url string) {}
+
+var SourcesMetrics SourceMetrics = noSourceMetrics{}
+
+// SourcesHTTPTransport, if set, is used for all source downloads instead of
+// the transports built from the options of each source, for example to
+// return canned responses in tests.
+var SourcesHTTPTransport http.RoundTripper
+
+// SourceCacheNamer maps a source URL and its configured cache file to the
+// paths where the source and its signature are cached. Other cache files,
+// such as the serial number, are stored next to the source.
+type SourceCacheNamer func(url string, cacheFile string) (string, string)
+
+func defaultSourceCacheNamer(url string, cacheFile string) (string, string) {
+	return cacheFile, cacheFile + ".minisig"
+}
+
+var SourcesCacheNamer SourceCacheNamer = defaultSourceCacheNamer
+
+type SourceState int
+
+const (
+	SourceStateUnknown = SourceState(iota)
+	SourceStateLoadedFresh
+	SourceStateServedFromCache
+	SourceStateRefreshFailed
+	SourceStateSignatureInvalid
+)
+
+func (state SourceState) String() string {
+	switch state {
+	case SourceStateLoadedFresh:
+		return "loaded-fresh"
+	case SourceStateServedFromCache:
+		return "served-from-cache"
+	case SourceStateRefreshFailed:
+		return "refresh-failed"
+	case SourceStateSignatureInvalid:
+		return "signature-invalid"
+	}
+	return "unknown"
+}
+
+// SourceObserver is notified when a source URL changes state. since is the
+// time of the transition, lastSuccess the time of the last successful
+// download, or the zero time if there wasn't any.
+type SourceObserver interface {
+	SourceStateChanged(url string, state SourceState, since time.Time, lastSuccess time.Time)
+}
+
+type noSourceObserver struct{}
+
+func (noSourceObserver) SourceStateChanged(url string, state SourceState, since time.Time, lastSuccess time.Time) {
+}
+
+var SourcesObserver SourceObserver = noSourceObserver{}
+
+func localSourcePath(url string) (string, bool) {
+	if strings.HasPrefix(url, "file://") {
+		return url[7:], true
+	}
+	if isStdinSourceURL(url) || strings.Contains(url, "://") {
+		return "", false
+	}
+	return url, true
 }
 
-func PrefetchSourceURL(urlToPrefetch *URLToPrefetch) error {
-	in, _, delayTillNextUpdate, err := fetchWithCache(urlToPrefetch.url, urlToPrefetch.cacheFile)
+func fetchFromFile(path string) (string, error) {
+	dlog.Infof("Loading source information from file [%s]", path)
+	bin, err := ioutil.ReadFile(path)
 	if err == nil {
-		AtomicFileWrite(urlToPrefetch.cacheFile, []byte(in))
+		bin, err = gunzipIfCompressed(bin)
 	}
-	urlToPrefetch.when = time.Now().Add(delayTillNextUpdate)
-	return err
+	return string(bin), err
+}
+
+func fetchFromURL(ctx context.Context, url string, noCache bool, fetchOptions *SourceFetchOptions) (string, error) {
+	if path, ok := localSourcePath(url); ok {
+		return fetchFromFile(path)
+	}
+	resp, err := fetchHTTP(ctx, url, noCache, fetchOptions, nil, "")
+	return resp.in, err
+}
+
+// fetchHTTP downloads url, retrying with exponential backoff. If partFile is
+// set, interrupted downloads are kept there and resumed with range requests.
+// Every attempt waits for a download slot, which is not held during backoffs.
+func fetchHTTP(ctx context.Context, url string, noCache bool, fetchOptions *SourceFetchOptions, validators *cacheValidators, partFile string) (fetchResp httpFetchResponse, err error) {
+	if fetchOptions != nil && fetchOptions.offline {
+		err = fmt.Errorf("Offline mode - not downloading [%s]", url)
+		return
+	}
+	attempts := 1
+	if fetchOptions != nil && fetchOptions.attempts > 1 {
+		attempts = fetchOptions.attempts
+	}
+	backoff := SourceFetchInitialBackoff
+	for attempt := 1; ; attempt++ {
+		var release func()
+		if release, err = acquireFetchSlot(ctx, url); err != nil {
+			return
+		}
+		fetchResp, err = fetchHTTPOnce(ctx, url, noCache, fetchOptions, validators, partFile)
+		release()
+		if err == nil || attempt >= attempts || fetchResp.retryAfter > 0 || isNonTransientHTTPStatus(fetchResp.statusCode) {
+			return
+		}
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		dlog.Infof("Fetching [%s] failed (%s) - retrying in %v (attempt %d/%d)", url, err, delay, attempt+1, attempts)
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+func fetchHTTPOnce(ctx context.Context, url string, noCache bool, fetchOptions *SourceFetchOptions, validators *cacheValidators, partFile string) (fetchResp httpFetchResponse, err error) {
+	var req *http.Request
+	req, err = http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	if validators != nil {
+		if len(validators.etag) > 0 {
+			req.Header.Set("If-None-Match", validators.etag)
+		}
+		if len(validators.lastModified) > 0 {
+			req.Header.Set("If-Modified-Since", validators.lastModified)
+		}
+	}
+	if noCache {
+		req.Header.Set("Cache-Control", "no-cache")
+		req.Header.Set("Pragma", "no-cache")
+	}
+	req.Header.Set("Accept-Encoding", sourceAcceptEncoding())
+	partial, resuming := partialDownload{}, false
+	if len(partFile) > 0 {
+		if partial, resuming = loadPartialDownload(partFile, url); resuming {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(partial.bin)))
+			req.Header.Set("If-Range", partial.validator)
+		}
+	}
+	req.Header.Set("User-Agent", DefaultSourceUserAgent)
+	if fetchOptions != nil {
+		if len(fetchOptions.username) > 0 {
+			req.SetBasicAuth(fetchOptions.username, fetchOptions.password)
+		}
+		if len(fetchOptions.userAgent) > 0 {
+			req.Header.Set("User-Agent", fetchOptions.userAgent)
+		}
+		for name, value := range fetchOptions.headers {
+			req.Header.Set(name, value)
+			dlog.Debugf("Sending header [%s: (redacted)] to [%s]", name, url)
+		}
+	}
+	timeout := DefaultSourceFetchTimeout
+	if fetchOptions != nil && fetchOptions.timeout > 0 {
+		timeout = fetchOptions.timeout
+	}
+	client := http.Client{Timeout: timeout}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= MaxSourceRedirects {
+			return fmt.Errorf("Too many redirects for [%s]", url)
+		}
+		if fetchOptions != nil && fetchOptions.sameDomainRedirects && registrableDomain(req.URL.Hostname()) != registrableDomain(via[0].URL.Hostname()) {
+			return fmt.Errorf("Redirect from [%s] to a different domain [%s] refused", url, req.URL.Hostname())
+		}
+		return nil
+	}
+	if SourcesHTTPTransport != nil {
+		client.Transport = SourcesHTTPTransport
+	} else if fetchOptions != nil && fetchOptions.transport != nil {
+		client.Transport = fetchOptions.transport
+	}
+	var resp *http.Response
+	dlog.Infof("Loading source information from URL [%s]", url)
+	resp, err = client.Do(req.WithContext(ctx))
+	if err != nil && strings.Contains(err.Error(), "protocol version") {
+		minTLSVersion := DefaultSourceMinTLSVersion
+		if fetchOptions != nil && fetchOptions.minTLSVersion != 0 {
+			minTLSVersion = fetchOptions.minTLSVersion
+		}
+		err = fmt.Errorf("[%s] doesn't support TLS %s or later (%s)", url, tlsVersionName(minTLSVersion), err)
+	}
+	if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || ctx.Err() == context.DeadlineExceeded {
+		dlog.Noticef("Timeout while loading source information from URL [%s]", url)
+	}
+	if err == nil && resp != nil && resp.StatusCode == http.StatusNotModified && validators != nil {
+		resp.Body.Close()
+		fetchResp.notModified = true
+		fetchResp.maxAge, fetchResp.hasMaxAge = parseCacheMaxAge(resp.Header)
+		return
+	} else if err == nil && resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		resp.Body.Close()
+		fetchResp.statusCode = resp.StatusCode
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if retryAfter, ok := parseRetryAfter(resp.Header); ok {
+				fetchResp.retryAfter = retryAfter
+				err = fmt.Errorf("Webserver returned code %d - retrying after %v", resp.StatusCode, retryAfter)
+				return
+			}
+		}
+		err = fmt.Errorf("Webserver returned code %d", resp.StatusCode)
+		return
+	} else if err != nil {
+		return
+	} else if resp == nil {
+		err = errors.New("Webserver returned an error")
+		return
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		cert := resp.TLS.PeerCertificates[0]
+		dlog.Debugf("[%s] was served with a certificate for [%s] issued by [%s]", url, cert.Subject.CommonName, cert.Issuer.CommonName)
+	}
+	if fetchOptions == nil || !fetchOptions.ignoreContentType {
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+			resp.Body.Close()
+			err = fmt.Errorf("Expected a resolver list from [%s], got text/html", url)
+			return
+		}
+	}
+	maxSize := int64(DefaultSourceMaxSize)
+	if fetchOptions != nil && fetchOptions.maxSize > 0 {
+		maxSize = fetchOptions.maxSize
+	}
+	if strings.HasSuffix(url, ".minisig") && maxSize > SourceSigMaxSize {
+		maxSize = SourceSigMaxSize
+	}
+	var received []byte
+	if resuming && resp.StatusCode == http.StatusPartialContent {
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", len(partial.bin))) {
+			resp.Body.Close()
+			removePartialDownload(partFile)
+			err = fmt.Errorf("Unexpected range returned by [%s]", url)
+			return
+		}
+		dlog.Infof("Resuming the download of [%s] after %d bytes", url, len(partial.bin))
+		received = partial.bin
+	}
+	if int64(len(received)) >= maxSize {
+		resp.Body.Close()
+		removePartialDownload(partFile)
+		err = fmt.Errorf("Response is larger than %d bytes", maxSize)
+		return
+	}
+	var bin []byte
+	bin, err = readAtMost(resp.Body, maxSize-int64(len(received)))
+	resp.Body.Close()
+	if err != nil {
+		if len(partFile) > 0 && len(bin) > 0 && (resp.StatusCode == http.StatusPartialContent || strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")) {
+			storePartialDownload(partFile, url, append(received, bin...), resp.Header)
+		}
+		return
+	}
+	bin = append(received, bin...)
+	if len(partFile) > 0 {
+		removePartialDownload(partFile)
+	}
+	if bin, err = decodeContent(bin, resp.Header.Get("Content-Encoding"), maxSize); err != nil {
+		return
+	}
+	fetchResp.in = string(bin)
+	fetchResp.validators = cacheValidators{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}
+	fetchResp.maxAge, fetchResp.hasMaxAge = parseCacheMaxAge(resp.Header)
+	return
+}
+
+// SourceContentDecoders are the content encodings accepted when downloading
+// sources, by name. Only these are advertised in Accept-Encoding. Embedders
+// can remove the encodings they don't want to be used, such as "br", or
+// register other ones.
+var SourceContentDecoders = map[string]func(io.Reader) (io.Reader, error){
+	"br":   func(reader io.Reader) (io.Reader, error) { return brotli.NewReader(reader, nil) },
+	"gzip": func(reader io.Reader) (io.Reader, error) { return gzip.NewReader(reader) },
+}
+
+func sourceAcceptEncoding() string {
+	var encodings []string
+	for encoding := range SourceContentDecoders {
+		encodings = append(encodings, encoding)
+	}
+	if len(encodings) == 0 {
+		return "identity"
+	}
+	sort.Strings(encodings)
+	return strings.Join(encodings, ", ")
+}
+
+// decodeContent decodes a response according to its Content-Encoding header.
+// Responses without an encoding are still decompressed if they look like
+// gzip data, for servers that don't set the header.
+func decodeContent(bin []byte, contentEncoding string, maxSize int64) ([]byte, error) {
+	contentEncoding = strings.ToLower(strings.TrimFunc(contentEncoding, unicode.IsSpace))
+	if len(contentEncoding) == 0 || contentEncoding == "identity" {
+		if isGzipCompressed(bin) {
+			return gunzip(bin, maxSize)
+		}
+		return bin, nil
+	}
+	decoder, ok := SourceContentDecoders[contentEncoding]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported content encoding [%s]", contentEncoding)
+	}
+	reader, err := decoder(bytes.NewReader(bin))
+	if err != nil {
+		return nil, err
+	}
+	return readAtMost(reader, maxSize)
+}
+
+func isGzipCompressed(bin []byte) bool {
+	return len(bin) >= 2 && bin[0] == 0x1f && bin[1] == 0x8b
+}
+
+// partialDownload is the beginning of an interrupted download, and the
+// validator that the rest of the download must match.
+type partialDownload struct {
+	bin       []byte
+	validator string
+}
+
+func loadPartialDownload(partFile string, url string) (partialDownload, bool) {
+	bin, err := SourcesCache.Read(partFile)
+	if err != nil || len(bin) == 0 {
+		return partialDownload{}, false
+	}
+	meta, err := SourcesCache.Read(partFile + ".validator")
+	if err != nil {
+		return partialDownload{}, false
+	}
+	lines := strings.SplitN(string(meta), "\n", 2)
+	if len(lines) != 2 || lines[0] != url || len(lines[1]) == 0 {
+		return partialDownload{}, false
+	}
+	return partialDownload{bin: bin, validator: lines[1]}, true
+}
+
+func storePartialDownload(partFile string, url string, bin []byte, header http.Header) {
+	validator := header.Get("ETag")
+	if len(validator) == 0 || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if len(bin) == 0 || len(validator) == 0 {
+		removePartialDownload(partFile)
+		return
+	}
+	dlog.Noticef("Download of [%s] interrupted after %d bytes - it will be resumed", url, len(bin))
+	SourcesCache.Write(partFile, bin)
+	SourcesCache.Write(partFile+".validator", []byte(url+"\n"+validator))
+}
+
+func removePartialDownload(partFile string) {
+	SourcesCache.Remove(partFile)
+	SourcesCache.Remove(partFile + ".validator")
+}
+
+func readAtMost(reader io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+	bin, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err == nil && int64(len(bin)) > maxSize {
+		return nil, fmt.Errorf("Response is larger than %d bytes", maxSize)
+	}
+	return bin, err
+}
+
+func gunzip(bin []byte, maxSize int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(bin))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readAtMost(reader, maxSize)
+}
+
+func gunzipIfCompressed(bin []byte) ([]byte, error) {
+	if !isGzipCompressed(bin) {
+		return bin, nil
+	}
+	return gunzip(bin, 0)
+}
+
+func AtomicFileWrite(file string, data []byte) error {
+	return safefile.WriteFile(file, data, 0644)
+}
+
+// AtomicFilePairWrite only replaces the files once both of them have been fully
+// written, so that a body is never left next to a signature for different content.
+func AtomicFilePairWrite(file string, data []byte, sigFile string, sigData []byte) error {
+	f, err := safefile.Create(file, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sigF, err := safefile.Create(sigFile, 0644)
+	if err != nil {
+		return err
+	}
+	defer sigF.Close()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if _, err = sigF.Write(sigData); err != nil {
+		return err
+	}
+	if err = sigF.Commit(); err != nil {
+		return err
+	}
+	if err = f.Commit(); err != nil {
+		os.Remove(file)
+		os.Remove(sigFile)
+	}
+	return err
+}
+
+func (source *Source) storeCache(in string, sigStr string) {
+	if err := source.writeCache(in, sigStr); err != nil {
+		source.warnf("%s: %s", source.cacheFile, err)
+	}
+}
+
+// writeCache stores the source and its signature together, so that a cache
+// file is never left next to the signature of a different version.
+func (source *Source) writeCache(in string, sigStr string) error {
+	if source.fetchOptions.insecureNoSignature {
+		if err := SourcesCache.Write(source.cacheFile, source.fetchOptions.cacheData(in)); err != nil {
+			return err
+		}
+		storeContentHash(source.cacheFile, in)
+		return nil
+	}
+	if err := writeSourceCachePair(source.cacheFile, source.fetchOptions.cacheData(in), source.sigCacheFile, []byte(sigStr)); err != nil {
+		return err
+	}
+	storeContentHash(source.cacheFile, in)
+	storeContentHash(source.sigCacheFile, sigStr)
+	return nil
+}
+
+type SourceFetchOptions struct {
+	headers             map[string]string
+	userAgent           string
+	username            string
+	password            string
+	resumeDownloads     bool
+	jitterPercent       int
+	jitterSeed          string
+	jitterRatio         float64
+	attempts            int
+	timeout             time.Duration
+	httpProxy           string
+	socksProxy          string
+	minTLSVersion       uint16
+	transport           http.RoundTripper
+	idleConnTimeout     time.Duration
+	negativeCacheTTL    time.Duration
+	pinOnFirstUse       bool
+	maxSize             int64
+	insecureNoSignature bool
+	warnOnlySignature   bool
+	sigAlgorithms       []string
+	inlineSig           string
+	ignoreContentType   bool
+	sameDomainRedirects bool
+	spkiPins            []string
+	maxShrinkPercent    int
+	bootstrapResolver   string
+	staleCacheExpiry    time.Duration
+	compressCache       bool
+	offline             bool
+	stampTransformer    StampTransformer
+	// Settings of the source itself, that NewSource already needs when it
+	// parses the downloaded content
+	name           string
+	lenient        bool
+	allowPrivate   bool
+	addressFamily  string
+	resolveHosts   bool
+	formatFallback bool
+}
+
+// initJitter picks the offset applied to the refreshes of a source, once for
+// the source and its signature. With a seed, the offset is always the same for
+// a given source.
+func (fetchOptions *SourceFetchOptions) initJitter(url string) {
+	if fetchOptions.jitterPercent <= 0 {
+		return
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano())).Float64()
+	if len(fetchOptions.jitterSeed) > 0 {
+		hash := sha256.Sum256([]byte(fetchOptions.jitterSeed + "\x00" + url))
+		r = float64(binary.BigEndian.Uint64(hash[:8])>>11) / (1 << 53)
+	}
+	fetchOptions.jitterRatio = 2*r - 1
+}
+
+// jitter moves a regular refresh by up to jitterPercent of delay, so that
+// proxies started at the same time don't all download a source together.
+// It is applied to the refresh delay, not to the remaining time of a cache
+// entry. Delays requested by servers and backoffs are not jittered.
+func (fetchOptions *SourceFetchOptions) jitter(delay time.Duration) time.Duration {
+	if fetchOptions == nil || fetchOptions.jitterPercent <= 0 || delay <= 0 {
+		return delay
+	}
+	return delay + time.Duration(fetchOptions.jitterRatio*float64(delay)*float64(fetchOptions.jitterPercent)/100)
+}
+
+// cacheData returns the data to store in the cache for the source (not the
+// signature), compressed if requested.
+func (fetchOptions *SourceFetchOptions) cacheData(in string) []byte {
+	if fetchOptions == nil || !fetchOptions.compressCache {
+		return []byte(in)
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(in)); err != nil {
+		return []byte(in)
+	}
+	if err := writer.Close(); err != nil {
+		return []byte(in)
+	}
+	return buf.Bytes()
+}
+
+func readCachedSource(cacheFile string) ([]byte, error) {
+	bin, err := SourcesCache.Read(cacheFile)
+	if err != nil {
+		return bin, err
+	}
+	return gunzipIfCompressed(bin)
+}
+
+// DefaultSourceIdleConnTimeout is how long connections to the servers of the
+// sources are kept open after a download, so that the signature and the
+// other sources hosted on the same server can reuse them.
+const DefaultSourceIdleConnTimeout = 90 * time.Second
+
+// SourceResolveTimeout is the maximum time spent resolving the host name of a
+// server, to check its address family.
+const SourceResolveTimeout = time.Duration(5) * time.Second
+
+// resolver returns the resolver for the host names of sources and servers,
+// which is the bootstrap resolver if one was configured.
+func (fetchOptions *SourceFetchOptions) resolver() (*net.Resolver, error) {
+	if fetchOptions == nil || len(fetchOptions.bootstrapResolver) == 0 {
+		return net.DefaultResolver, nil
+	}
+	resolverAddr := fetchOptions.bootstrapResolver
+	if net.ParseIP(resolverAddr) != nil {
+		resolverAddr = net.JoinHostPort(resolverAddr, "53")
+	}
+	if host, _, err := net.SplitHostPort(resolverAddr); err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("Invalid bootstrap resolver for sources: [%s] - an IP address is required", fetchOptions.bootstrapResolver)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, resolverAddr)
+	}}, nil
+}
+
+var (
+	sourcesTransportsLock sync.Mutex
+	sourcesTransports     = make(map[string]*http.Transport)
+)
+
+// sharedSourcesHTTPTransport returns the same transport for all the sources
+// with the same connection settings, so that they share their connections.
+func sharedSourcesHTTPTransport(fetchOptions *SourceFetchOptions) (*http.Transport, error) {
+	key := fmt.Sprintf("%d\x00%s\x00%s\x00%s\x00%s\x00%v", fetchOptions.minTLSVersion, fetchOptions.bootstrapResolver, fetchOptions.httpProxy, fetchOptions.socksProxy, strings.Join(fetchOptions.spkiPins, ","), fetchOptions.idleConnTimeout)
+	sourcesTransportsLock.Lock()
+	defer sourcesTransportsLock.Unlock()
+	if transport, ok := sourcesTransports[key]; ok {
+		return transport, nil
+	}
+	transport, err := newSourcesHTTPTransport(fetchOptions)
+	if err != nil {
+		return nil, err
+	}
+	sourcesTransports[key] = transport
+	return transport, nil
+}
+
+func newSourcesHTTPTransport(fetchOptions *SourceFetchOptions) (*http.Transport, error) {
+	minTLSVersion := fetchOptions.minTLSVersion
+	if minTLSVersion == 0 {
+		minTLSVersion = DefaultSourceMinTLSVersion
+	}
+	idleConnTimeout := fetchOptions.idleConnTimeout
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = DefaultSourceIdleConnTimeout
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{MinVersion: minTLSVersion},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        16,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     idleConnTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if len(fetchOptions.bootstrapResolver) > 0 {
+		resolver, err := fetchOptions.resolver()
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: resolver}
+		transport.DialContext = dialer.DialContext
+	}
+	if len(fetchOptions.httpProxy) > 0 {
+		proxyURL, err := url.Parse(fetchOptions.httpProxy)
+		if err != nil || len(proxyURL.Host) == 0 || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") {
+			return nil, fmt.Errorf("Invalid HTTP proxy URL for sources: [%s]", fetchOptions.httpProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if len(fetchOptions.socksProxy) > 0 {
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: fetchOptions.socksProxy})
+	}
+	if len(fetchOptions.spkiPins) > 0 {
+		pins := make(map[string]bool, len(fetchOptions.spkiPins))
+		for _, pinStr := range fetchOptions.spkiPins {
+			pin, err := base64.StdEncoding.DecodeString(pinStr)
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("Invalid SPKI pin: [%s]", pinStr)
+			}
+			pins[string(pin)] = true
+		}
+		transport.TLSClientConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo); pins[string(hash[:])] {
+						return nil
+					}
+				}
+			}
+			return errors.New("The certificate of the server doesn't match any of the SPKI pins of the source")
+		}
+	}
+	return transport, nil
+}
+
+type URLToPrefetch struct {
+	url          string
+	mirrors      []string
+	cacheFile    string
+	when         time.Time
+	refreshDelay time.Duration
+	fetchOptions *SourceFetchOptions
+	lastError    error
+	failures     int
+	state        SourceState
+	lastSuccess  time.Time
+	changed      bool
+	source       *Source
+}
+
+// Changed returns true if the last prefetch downloaded content that differs
+// from the previously cached one, so that callers can skip parsing it again.
+func (urlToPrefetch *URLToPrefetch) Changed() bool {
+	return urlToPrefetch.changed
+}
+
+type PrefetchQueue []URLToPrefetch
+
+func (queue PrefetchQueue) Earliest() (time.Time, bool) {
+	var earliest time.Time
+	for i, urlToPrefetch := range queue {
+		if i == 0 || urlToPrefetch.when.Before(earliest) {
+			earliest = urlToPrefetch.when
+		}
+	}
+	return earliest, len(queue) > 0
+}
+
+func (queue PrefetchQueue) Sort() {
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].when.Before(queue[j].when) })
+}
+
+func (queue PrefetchQueue) Prefetch(ctx context.Context) {
+	for {
+		now := SourcesNow()
+		for i := range queue {
+			urlToPrefetch := &queue[i]
+			if now.Before(urlToPrefetch.when) {
+				continue
+			}
+			dlog.Debugf("Prefetching [%s]", urlToPrefetch.url)
+			if err := PrefetchSourceURL(ctx, urlToPrefetch); err != nil {
+				dlog.Debugf("Prefetching [%s] failed (%d consecutive failures): %s", urlToPrefetch.url, urlToPrefetch.failures, err)
+			} else {
+				dlog.Debugf("Prefetching [%s] succeeded. Next refresh scheduled for %v", urlToPrefetch.url, urlToPrefetch.when)
+			}
+		}
+		earliest, ok := queue.Earliest()
+		if !ok {
+			return
+		}
+		delay := earliest.Sub(SourcesNow())
+		if delay < MinSourcesUpdateDelay {
+			delay = MinSourcesUpdateDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func NewSource(ctx context.Context, url string, mirrors []string, minisignKeyStr string, cacheFile string, formatStr string, refreshDelay time.Duration, fetchOptions SourceFetchOptions) (Source, []URLToPrefetch, error) {
+	if refreshDelay < MinSourcesUpdateDelay {
+		refreshDelay = MinSourcesUpdateDelay
+	}
+	cacheFile, sigCacheFile := SourcesCacheNamer(url, cacheFile)
+	source := Source{url: url, mirrors: mirrors, cacheFile: cacheFile, sigCacheFile: sigCacheFile, refreshDelay: refreshDelay, stampTransformer: fetchOptions.stampTransformer, fetchOptions: fetchOptions,
+		name: fetchOptions.name, lenient: fetchOptions.lenient, allowPrivate: fetchOptions.allowPrivate, addressFamily: fetchOptions.addressFamily,
+		resolveHosts: fetchOptions.resolveHosts, formatFallback: fetchOptions.formatFallback}
+	if fetchOptions.transport == nil && SourcesHTTPTransport == nil {
+		transport, err := sharedSourcesHTTPTransport(&fetchOptions)
+		if err != nil {
+			return source, []URLToPrefetch{}, err
+		}
+		source.fetchOptions.transport = transport
+	}
+	source.fetchOptions.initJitter(url)
+	if formatStr == "auto" {
+		source.autoFormat = true
+	} else {
+		format, err := sourceFormatFromString(formatStr)
+		if err != nil {
+			return source, []URLToPrefetch{}, err
+		}
+		source.format = format
+	}
+	var err error
+	if fetchOptions.insecureNoSignature {
+		// No signature is downloaded nor scheduled for a refresh, whatever the
+		// format, so that unsigned v1 lists from internal tooling can be used
+		dlog.Warnf("*** Signature verification is DISABLED for source [%s] - its content will be used without being verified ***", url)
+		if !source.autoFormat && source.format == SourceFormatV1 {
+			dlog.Warnf("*** Anyone able to modify the v1 list at [%s] can make the proxy use any server ***", url)
+		}
+	} else {
+		if fetchOptions.warnOnlySignature {
+			dlog.Warnf("*** INSECURE: signature verification is in WARN-ONLY mode for source [%s] - invalid or missing signatures will NOT prevent it from being used ***", url)
+		}
+		if source.minisignKeys, err = parseMinisignKeys(minisignKeyStr); err != nil {
+			return source, []URLToPrefetch{}, err
+		}
+	}
+	now := SourcesNow()
+	urlsToPrefetch := []URLToPrefetch{}
+
+	var in, sigStr string
+	var cached, sigCached, stale bool
+	var delayTillNextUpdate, sigDelayTillNextUpdate time.Duration
+	var sigErr error
+	sourceURLs := source.urls()
+	for i, sourceURL := range sourceURLs {
+		sigDone := make(chan struct{})
+		go func() {
+			sigStr, sigCached, sigDelayTillNextUpdate, sigErr = source.fetchSignature(ctx, sourceURL, false)
+			close(sigDone)
+		}()
+		in, cached, stale, delayTillNextUpdate, err = fetchWithCache(ctx, sourceURL, cacheFile, refreshDelay, &source.fetchOptions)
+		<-sigDone
+		if i == len(sourceURLs)-1 || (err == nil && sigErr == nil && !stale) {
+			break
+		}
+		reason := "stale cache"
+		if err != nil {
+			reason = err.Error()
+		} else if sigErr != nil {
+			reason = sigErr.Error()
+		}
+		source.warnf("Unable to download [%s] (%s) - trying the mirror at [%s]", sourceURL, reason, sourceURLs[i+1])
+	}
+	if sigDelayTillNextUpdate < delayTillNextUpdate {
+		delayTillNextUpdate = sigDelayTillNextUpdate
+	}
+	nextUpdate := now.Add(delayTillNextUpdate)
+	urlsToPrefetch = append(urlsToPrefetch, URLToPrefetch{url: url, mirrors: mirrors, cacheFile: cacheFile, when: nextUpdate, refreshDelay: refreshDelay, fetchOptions: &source.fetchOptions, source: &source})
+	// Cache files are only written after having been verified
+	if modTime, err := SourcesCache.ModTime(cacheFile); err == nil {
+		urlsToPrefetch[0].lastSuccess = modTime
+	}
+
+	if err == nil && sigErr != nil && fetchOptions.warnOnlySignature {
+		source.warnf("*** INSECURE: the signature of source [%s] could not be downloaded (%s) - using it anyway, because of signature_warn_only ***", url, sigErr)
+		sigStr, sigCached, sigErr = "", true, nil
+	}
+	if err != nil || sigErr != nil {
+		if err == nil {
+			err = sigErr
+		}
+		source.fetchFailures++
+		urlsToPrefetch[0].setState(SourceStateRefreshFailed, now)
+		return source, urlsToPrefetch, err
+	}
+
+	if err = source.verify(in, sigStr); err != nil {
+		SourcesMetrics.SignatureVerificationFailed(url)
+		in, sigStr, err = source.fetchAndVerifyUncached(ctx)
+		_, rollback := err.(*SourceRollbackError)
+		if rollback {
+			if cachedIn, cachedSigStr, cacheErr := source.loadVerifiedCache(); cacheErr == nil {
+				source.warnf("%s - using the cached version instead", err)
+				in, sigStr, err = cachedIn, cachedSigStr, nil
+				cached, sigCached, stale = true, true, true
+			}
+		} else if err == nil {
+			cached, sigCached, stale = false, false, false
+		}
+		if err != nil {
+			if !rollback {
+				SourcesCache.Remove(cacheFile)
+				SourcesCache.Remove(sigCacheFile)
+			}
+			source.fetchFailures++
+			urlsToPrefetch[0].setState(SourceStateSignatureInvalid, now)
+			return source, urlsToPrefetch, err
+		}
+	}
+	if cached && sigCached {
+		source.cacheHits++
+	}
+	source.dataTime, source.stale = now, stale
+	if cached {
+		if modTime, err := SourcesCache.ModTime(cacheFile); err == nil {
+			source.dataTime = modTime
+		}
+	}
+	urlsToPrefetch[0].lastSuccess = source.dataTime
+	if stale {
+		source.warnf("Source [%s] is stale - using data from %v", url, source.dataTime)
+		urlsToPrefetch[0].setState(SourceStateServedFromCache, now)
+	} else {
+		urlsToPrefetch[0].setState(SourceStateLoadedFresh, now)
+	}
+	if source.autoFormat {
+		if source.format, err = detectSourceFormat(in); err != nil {
+			return source, urlsToPrefetch, fmt.Errorf("%s for source at [%s] - Please specify the format explicitly", err, url)
+		}
+		dlog.Noticef("Source [%s] detected as format v%d", url, source.format+1)
+	}
+	if _, isLocal := localSourcePath(url); isLocal {
+		cached, sigCached = true, true
+	}
+	if !cached && fetchOptions.maxShrinkPercent > 0 {
+		if oldIn, oldSigStr, ok := source.keepLongerCachedList(in); ok {
+			in, sigStr, cached, sigCached = oldIn, oldSigStr, true, true
+		}
+	}
+	if !cached && !sigCached {
+		source.storeCache(in, sigStr)
+	} else if !cached {
+		if err = SourcesCache.Write(cacheFile, source.fetchOptions.cacheData(in)); err != nil {
+			source.warnf("%s: %s", cacheFile, err)
+		} else {
+			storeContentHash(cacheFile, in)
+		}
+	} else if !sigCached {
+		if err = SourcesCache.Write(sigCacheFile, []byte(sigStr)); err != nil {
+			source.warnf("%s: %s", sigCacheFile, err)
+		} else {
+			storeContentHash(sigCacheFile, sigStr)
+		}
+	}
+	source.storeSerial()
+	source.storeTimestamp()
+	source.checkDigest(in)
+	dlog.Noticef("Source [%s] loaded", url)
+	source.in = in
+	source.when = nextUpdate
+	source.lastUpdate = now
+	return source, urlsToPrefetch, nil
+}
+
+// NewSourceFromString builds a source from content that is already trusted.
+// Nothing is fetched, cached or verified, so the source is never prefetched.
+func NewSourceFromString(name string, content string, format SourceFormat) (Source, error) {
+	source := Source{url: MemorySourceURLPrefix + name, name: name, in: content, format: format}
+	if format != SourceFormatV1 && format != SourceFormatV2 && format != SourceFormatV3 {
+		return source, fmt.Errorf("Unsupported source format for [%s]", name)
+	}
+	source.dataTime = SourcesNow()
+	source.lastUpdate = source.dataTime
+	return source, nil
+}
+
+func parseMinisignKeys(minisignKeyStr string) ([]minisign.PublicKey, error) {
+	var minisignKeys []minisign.PublicKey
+	for _, keyStr := range strings.FieldsFunc(minisignKeyStr, func(c rune) bool { return c == ',' || unicode.IsSpace(c) }) {
+		keyStr, err := minisignKeyFromFile(keyStr)
+		if err != nil {
+			return minisignKeys, err
+		}
+		minisignKey, err := minisign.NewPublicKey(keyStr)
+		if err != nil {
+			return minisignKeys, err
+		}
+		minisignKeys = append(minisignKeys, minisignKey)
+	}
+	if len(minisignKeys) == 0 {
+		return minisignKeys, errors.New("Missing Minisign key")
+	}
+	return minisignKeys, nil
+}
+
+// minisignKeyFromFile returns the key stored in the file named keyStr, either
+// as written by minisign or as a single line, or keyStr if there is no such file.
+func minisignKeyFromFile(keyStr string) (string, error) {
+	if fi, err := os.Stat(keyStr); err != nil || fi.IsDir() {
+		return keyStr, nil
+	}
+	bin, err := ioutil.ReadFile(keyStr)
+	if err != nil {
+		return "", err
+	}
+	var keyLines []string
+	for _, line := range strings.Split(normalizeSourceText(string(bin)), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		keyLines = append(keyLines, line)
+	}
+	if len(keyLines) != 1 {
+		return "", fmt.Errorf("[%s] is not a valid Minisign public key file", keyStr)
+	}
+	if _, err = minisign.NewPublicKey(keyLines[0]); err != nil {
+		return "", fmt.Errorf("[%s] is not a valid Minisign public key file: %s", keyStr, err)
+	}
+	return keyLines[0], nil
+}
+
+func (source *Source) verify(in string, sigStr string) error {
+	if source.fetchOptions.insecureNoSignature {
+		return nil
+	}
+	signature, err := source.verifySignature(in, sigStr)
+	if err != nil {
+		if !source.fetchOptions.warnOnlySignature {
+			return err
+		}
+		source.warnf("*** INSECURE: the signature of source [%s] could not be verified (%s) - using it anyway, because of signature_warn_only ***", source.url, err)
+		return nil
+	}
+	if err = source.checkTimestamp(signature.TrustedComment); err != nil {
+		return err
+	}
+	return source.checkSerial(in, signature.TrustedComment)
+}
+
+// verifySignature only checks the signature itself, not whether the source is
+// older than the cached version.
+func (source *Source) verifySignature(in string, sigStr string) (minisign.Signature, error) {
+	signature, err := minisign.DecodeSignature(sigStr)
+	if err != nil {
+		return signature, err
+	}
+	if err = source.checkSignatureAlgorithm(signature); err != nil {
+		return signature, err
+	}
+	keyIndex := -1
+	for i, minisignKey := range source.minisignKeys {
+		if signature.KeyId == minisignKey.KeyId {
+			keyIndex = i
+			break
+		}
+	}
+	if keyIndex < 0 {
+		return signature, fmt.Errorf("Signature for source at [%s] was made with a different key (key id: %X)", source.url, signature.KeyId)
+	}
+	res, err := source.minisignKeys[keyIndex].Verify([]byte(in), signature)
+	if err == nil && res {
+		dlog.Debugf("Signature for source at [%s] verified with key #%d", source.url, keyIndex+1)
+	}
+	if err != nil {
+		return signature, err
+	}
+	if !res {
+		return signature, fmt.Errorf("Invalid signature for source at [%s]", source.url)
+	}
+	return signature, source.checkFileName(signature.TrustedComment)
+}
+
+type SourceRollbackError struct {
+	message string
+}
+
+func (err *SourceRollbackError) Error() string {
+	return err.message
+}
+
+func trustedCommentTimestamp(trustedComment string) (int64, bool) {
+	tsStr, ok := trustedCommentField(trustedComment, "timestamp")
+	if !ok {
+		if tsStr, ok = trustedCommentField(trustedComment, "time"); !ok {
+			return 0, false
+		}
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	return ts, err == nil
+}
+
+func (source *Source) checkTimestamp(trustedComment string) error {
+	ts, ok := trustedCommentTimestamp(trustedComment)
+	if !ok {
+		dlog.Warnf("The signature for source at [%s] doesn't include a timestamp - rollbacks cannot be detected", source.url)
+		return nil
+	}
+	source.timestamp = 0
+	if lastTsStr, err := SourcesCache.Read(source.cacheFile + SourceTimestampSuffix); err == nil {
+		lastTs, err := strconv.ParseInt(strings.TrimFunc(string(lastTsStr), unicode.IsSpace), 10, 64)
+		if err == nil && ts < lastTs {
+			return &SourceRollbackError{fmt.Sprintf("Source at [%s] was signed at %v, before the cached version (%v) - refusing to roll back", source.url, time.Unix(ts, 0), time.Unix(lastTs, 0))}
+		}
+	}
+	source.timestamp = ts
+	return nil
+}
+
+// The timestamp of the last signature that was verified is stored next to the
+// cache file, since the cached signature itself can be replaced by the
+// prefetcher before it is verified.
+const SourceTimestampSuffix = ".timestamp"
+
+func (source *Source) storeTimestamp() {
+	if source.timestamp == 0 || len(source.cacheFile) == 0 {
+		return
+	}
+	timestampFile := source.cacheFile + SourceTimestampSuffix
+	if err := SourcesCache.Write(timestampFile, []byte(strconv.FormatInt(source.timestamp, 10))); err != nil {
+		dlog.Warnf("%s: %s", timestampFile, err)
+	}
+}
+
+// loadVerifiedCache returns the cached content of the source and its
+// signature, if they can still be verified.
+func (source *Source) loadVerifiedCache() (in string, sigStr string, err error) {
+	bin, err := readCachedSource(source.cacheFile)
+	if err != nil {
+		return
+	}
+	sigBin, err := SourcesCache.Read(source.sigCacheFile)
+	if err != nil {
+		return
+	}
+	in, sigStr = string(bin), string(sigBin)
+	err = source.verify(in, sigStr)
+	return
+}
+
+func trustedCommentField(trustedComment string, key string) (string, bool) {
+	trustedComment = strings.TrimPrefix(trustedComment, "trusted comment: ")
+	for _, field := range strings.Fields(trustedComment) {
+		if strings.HasPrefix(field, key+":") {
+			return field[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// Minisign signature algorithms. The official lists are signed with the
+// legacy algorithm. Prehashed signatures are computed over the BLAKE2b-512
+// hash of the content, which is what minisign uses for large files.
+var SourceSignatureAlgorithms = map[string]string{
+	"legacy":    "Ed",
+	"prehashed": "ED",
+}
+
+func (source *Source) checkSignatureAlgorithm(signature minisign.Signature) error {
+	algorithm := string(signature.SignatureAlgorithm[:])
+	if allowed := source.fetchOptions.sigAlgorithms; len(allowed) > 0 {
+		found := false
+		for _, name := range allowed {
+			if SourceSignatureAlgorithms[name] == algorithm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Signature for source at [%s] uses an algorithm that is not allowed: [%s]", source.url, algorithm)
+		}
+	}
+	return nil
+}
+
+// checkFileName rejects signatures whose trusted comment names a file other
+// than the one downloaded from the source or from one of its mirrors.
+func (source *Source) checkFileName(trustedComment string) error {
+	fileName, ok := trustedCommentField(trustedComment, "file")
+	if !ok {
+		return nil
+	}
+	for _, sourceURL := range source.urls() {
+		if sourceFileName(sourceURL) == fileName {
+			return nil
+		}
+	}
+	return fmt.Errorf("Signature for source at [%s] was made for a different file: [%s]", source.url, fileName)
+}
+
+func sourceFileName(sourceURL string) string {
+	if parsedURL, err := url.Parse(sourceURL); err == nil && len(parsedURL.Path) > 0 {
+		sourceURL = parsedURL.Path
+	}
+	return sourceURL[strings.LastIndex(sourceURL, "/")+1:]
+}
+
+func (source *Source) checkSerial(in string, trustedComment string) error {
+	source.serial = ""
+	var lastSerial uint64
+	lastSerialStr, err := SourcesCache.Read(source.cacheFile + ".serial")
+	hasLastSerial := false
+	if err == nil {
+		if lastSerial, err = strconv.ParseUint(strings.TrimFunc(string(lastSerialStr), unicode.IsSpace), 10, 64); err == nil {
+			hasLastSerial = true
+		}
+	}
+	serialStr, ok := trustedCommentField(trustedComment, "serial")
+	if !ok {
+		if hasLastSerial {
+			return fmt.Errorf("Signature for source at [%s] has no serial, but serial %d was previously seen", source.url, lastSerial)
+		}
+		return nil
+	}
+	serial, err := strconv.ParseUint(serialStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid serial in the signature for source at [%s]", source.url)
+	}
+	if hasLastSerial && serial <= lastSerial {
+		if serial < lastSerial || !source.isCachedContent(in) {
+			return fmt.Errorf("Source at [%s] has serial %d, which is not newer than the previously seen serial %d", source.url, serial, lastSerial)
+		}
+	}
+	source.serial = serialStr
+	return nil
+}
+
+func (source *Source) isCachedContent(in string) bool {
+	bin, err := readCachedSource(source.cacheFile)
+	return err == nil && string(bin) == in
+}
+
+func (source *Source) storeSerial() {
+	if len(source.serial) == 0 || len(source.cacheFile) == 0 {
+		return
+	}
+	serialFile := source.cacheFile + ".serial"
+	if err := SourcesCache.Write(serialFile, []byte(source.serial)); err != nil {
+		dlog.Warnf("%s: %s", serialFile, err)
+	}
+}
+
+// fetchSignature returns the signature of the source downloaded from
+// sourceURL, unless it doesn't have to be downloaded. With noCache, the cached
+// signature is ignored.
+func (source *Source) fetchSignature(ctx context.Context, sourceURL string, noCache bool) (sigStr string, sigCached bool, delayTillNextUpdate time.Duration, err error) {
+	if source.fetchOptions.insecureNoSignature {
+		return "", true, source.refreshDelay, nil
+	}
+	if len(source.fetchOptions.inlineSig) > 0 {
+		return source.fetchOptions.inlineSig, false, source.refreshDelay, nil
+	}
+	if noCache {
+		sigStr, err = fetchFromURL(ctx, sourceURL+".minisig", true, &source.fetchOptions)
+		return sigStr, false, source.refreshDelay, err
+	}
+	sigStr, sigCached, _, delayTillNextUpdate, err = fetchWithCache(ctx, sourceURL+".minisig", source.sigCacheFile, source.refreshDelay, &source.fetchOptions)
+	return
+}
+
+func (source *Source) fetchAndVerifyUncached(ctx context.Context) (in string, sigStr string, err error) {
+	if isStdinSourceURL(source.url) {
+		err = fmt.Errorf("Invalid signature for source at [%s]", source.url)
+		return
+	}
+	dlog.Noticef("Signature verification failed for [%s] - retrying without caches in case the content and the signature are out of sync", source.url)
+	in, sigStr, _, err = source.fetchAndVerify(ctx, true)
+	return
+}
+
+func (source *Source) urls() []string {
+	return append([]string{source.url}, source.mirrors...)
+}
+
+// fetchAndVerify downloads the source and its signature from the first mirror
+// that serves a pair that can be verified. fetched is false if none of them
+// could be downloaded at all.
+func (source *Source) fetchAndVerify(ctx context.Context, noCache bool) (in string, sigStr string, fetched bool, err error) {
+	for _, sourceURL := range source.urls() {
+		if in, err = fetchFromURL(ctx, sourceURL, noCache, &source.fetchOptions); err != nil {
+			dlog.Noticef("Unable to download [%s]: %s", sourceURL, err)
+			continue
+		}
+		if source.fetchOptions.insecureNoSignature {
+			fetched = true
+			return
+		}
+		if len(source.fetchOptions.inlineSig) > 0 {
+			sigStr = source.fetchOptions.inlineSig
+		} else if sigStr, err = fetchFromURL(ctx, sourceURL+".minisig", noCache, &source.fetchOptions); err != nil {
+			dlog.Noticef("Unable to download [%s.minisig]: %s", sourceURL, err)
+			if !source.fetchOptions.warnOnlySignature {
+				continue
+			}
+			sigStr = ""
+		}
+		fetched = true
+		if err = source.verify(in, sigStr); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// sourcesCacheLock serializes updates of the cache files, so that a forced
+// refresh and the prefetcher can't interleave writes to the same files.
+var sourcesCacheLock sync.Mutex
+
+func (source *Source) ServerCount() int {
+	return source.serverCount
+}
+
+func (source *Source) countServers(in string) int {
+	countedSource := *source
+	countedSource.in = in
+	registeredServers, _ := countedSource.parseFormat(countedSource.format, "")
+	return len(registeredServers)
+}
+
+func (source *Source) shrinksTooMuch(oldCount int, newCount int) bool {
+	maxShrinkPercent := source.fetchOptions.maxShrinkPercent
+	if maxShrinkPercent <= 0 || oldCount == 0 || newCount*100 >= oldCount*(100-maxShrinkPercent) {
+		return false
+	}
+	dlog.Warnf("Source [%s] went from %d to %d servers, which is more than the allowed %d%% drop", source.url, oldCount, newCount, maxShrinkPercent)
+	return true
+}
+
+// keepLongerCachedList returns the cached version of the source if the
+// downloaded one lists too few servers compared to it.
+func (source *Source) keepLongerCachedList(in string) (string, string, bool) {
+	oldIn, err := readCachedSource(source.cacheFile)
+	if err != nil {
+		return "", "", false
+	}
+	oldSigStr, err := SourcesCache.Read(source.sigCacheFile)
+	if err != nil && !source.fetchOptions.insecureNoSignature {
+		return "", "", false
+	}
+	if !source.shrinksTooMuch(source.countServers(string(oldIn)), source.countServers(in)) {
+		return "", "", false
+	}
+	if err = source.verify(string(oldIn), string(oldSigStr)); err != nil {
+		return "", "", false
+	}
+	dlog.Noticef("Keeping the cached version of source [%s]", source.url)
+	return string(oldIn), string(oldSigStr), true
+}
+
+// PromoteLastKnownGood saves the current content of the source as its last
+// known good snapshot, if it can be parsed and lists at least one server.
+func (source *Source) PromoteLastKnownGood() error {
+	sourcesCacheLock.Lock()
+	defer sourcesCacheLock.Unlock()
+	return source.promoteLastKnownGood()
+}
+
+// RollbackToLastKnownGood replaces the content of the source, and its cache
+// files, with the last known good snapshot. The snapshot is verified again,
+// but is allowed to be older than the current version.
+func (source *Source) RollbackToLastKnownGood() error {
+	sourcesCacheLock.Lock()
+	defer sourcesCacheLock.Unlock()
+	return source.rollbackToLastKnownGood()
+}
+
+func (source *Source) promoteLastKnownGood() error {
+	if _, isLocal := localSourcePath(source.url); isLocal || len(source.cacheFile) == 0 {
+		return nil
+	}
+	registeredServers, err := source.Parse("")
+	if err != nil {
+		return err
+	}
+	if len(registeredServers) == 0 {
+		return fmt.Errorf("Source [%s] doesn't list any servers", source.url)
+	}
+	goodFile := source.cacheFile + SourceLastKnownGoodSuffix
+	if goodIn, err := readCachedSource(goodFile); err == nil && string(goodIn) == source.in {
+		return nil
+	}
+	if source.fetchOptions.insecureNoSignature {
+		return SourcesCache.Write(goodFile, source.fetchOptions.cacheData(source.in))
+	}
+	sigStr, err := SourcesCache.Read(source.sigCacheFile)
+	if err != nil {
+		return err
+	}
+	if _, err = source.verifySignature(source.in, string(sigStr)); err != nil {
+		return err
+	}
+	dlog.Debugf("Source [%s] promoted to last known good", source.url)
+	return writeSourceCachePair(goodFile, source.fetchOptions.cacheData(source.in), goodFile+".minisig", sigStr)
+}
+
+func (source *Source) rollbackToLastKnownGood() error {
+	goodFile := source.cacheFile + SourceLastKnownGoodSuffix
+	goodIn, err := readCachedSource(goodFile)
+	if err != nil {
+		return fmt.Errorf("No last known good version of source [%s]", source.url)
+	}
+	var sigStr []byte
+	var signature minisign.Signature
+	if !source.fetchOptions.insecureNoSignature {
+		if sigStr, err = SourcesCache.Read(goodFile + ".minisig"); err != nil {
+			return err
+		}
+		if signature, err = source.verifySignature(string(goodIn), string(sigStr)); err != nil {
+			return err
+		}
+	}
+	format := source.format
+	if source.autoFormat {
+		if format, err = detectSourceFormat(string(goodIn)); err != nil {
+			return err
+		}
+	}
+	source.in, source.format = string(goodIn), format
+	source.storeCache(source.in, string(sigStr))
+	// The timestamp and serial of the newer version would make the snapshot
+	// look like a rollback the next time the cache is loaded
+	source.timestamp, source.serial = 0, ""
+	if ts, ok := trustedCommentTimestamp(signature.TrustedComment); ok {
+		source.timestamp = ts
+	}
+	if serialStr, ok := trustedCommentField(signature.TrustedComment, "serial"); ok {
+		source.serial = serialStr
+	}
+	SourcesCache.Remove(source.cacheFile + SourceTimestampSuffix)
+	SourcesCache.Remove(source.cacheFile + ".serial")
+	source.storeTimestamp()
+	source.storeSerial()
+	dlog.Noticef("Source [%s] rolled back to its last known good version", source.url)
+	return nil
+}
+
+func (source *Source) Refresh() (bool, error) {
+	return source.refreshWithCache(false)
+}
+
+// ForceRefresh downloads and verifies the source, bypassing both the cache
+// files and any HTTP cache on the way.
+func (source *Source) ForceRefresh() (bool, error) {
+	return source.refreshWithCache(true)
+}
+
+// ForceRefreshSource forces the refresh of the loaded source with the given
+// URL and cache file.
+func (proxy *Proxy) ForceRefreshSource(url string, cacheFile string) (bool, error) {
+	for _, source := range proxy.sources {
+		if source.url == url && source.cacheFile == cacheFile {
+			return source.ForceRefresh()
+		}
+	}
+	return false, fmt.Errorf("No source loaded from [%s] with cache file [%s]", url, cacheFile)
+}
+
+func (source *Source) refreshWithCache(noCache bool) (bool, error) {
+	if isStdinSourceURL(source.url) {
+		return false, errors.New("Sources read from the standard input cannot be refreshed")
+	}
+	if strings.HasPrefix(source.url, MemorySourceURLPrefix) {
+		return false, fmt.Errorf("Source [%s] was built from a string and cannot be refreshed", source.name)
+	}
+	sourcesCacheLock.Lock()
+	defer sourcesCacheLock.Unlock()
+	changed, err := source.refresh(context.Background(), noCache)
+	if err != nil {
+		source.fetchFailures++
+		return false, err
+	}
+	source.lastUpdate = SourcesNow()
+	source.dataTime, source.stale = source.lastUpdate, false
+	return changed, nil
+}
+
+// Staleness returns the age of the data the source was last loaded from,
+// and whether that data came from a cache file that couldn't be refreshed.
+func (source *Source) Staleness() (age time.Duration, stale bool) {
+	if source.dataTime.IsZero() {
+		return 0, source.stale
+	}
+	return SourcesNow().Sub(source.dataTime), source.stale
+}
+
+func (source *Source) refresh(ctx context.Context, noCache bool) (bool, error) {
+	in, sigStr, fetched, err := source.fetchAndVerify(ctx, noCache)
+	if err != nil {
+		if !fetched || noCache {
+			return false, err
+		}
+		if in, sigStr, err = source.fetchAndVerifyUncached(ctx); err != nil {
+			return false, err
+		}
+	}
+	refreshedSource := *source
+	refreshedSource.in = in
+	if source.autoFormat {
+		if refreshedSource.format, err = detectSourceFormat(in); err != nil {
+			return false, fmt.Errorf("%s for source at [%s] - Please specify the format explicitly", err, source.url)
+		}
+	}
+	newServers, err := refreshedSource.Parse("")
+	if err != nil {
+		return false, err
+	}
+	oldServers, _ := source.Parse("")
+	if source.shrinksTooMuch(len(oldServers), len(newServers)) {
+		return false, fmt.Errorf("Refusing to replace source [%s] with a much shorter list", source.url)
+	}
+	changed := !sameRegisteredServers(oldServers, newServers)
+	if _, isLocal := localSourcePath(source.url); !isLocal {
+		source.storeCache(in, sigStr)
+		source.storeSerial()
+		source.storeTimestamp()
+	}
+	source.checkDigest(in)
+	source.in = in
+	source.format = refreshedSource.format
+	source.serverCount = len(newServers)
+	source.when = SourcesNow().Add(source.refreshDelay)
+	if len(newServers) > 0 {
+		if err = source.promoteLastKnownGood(); err != nil {
+			dlog.Warnf("Unable to save the last known good version of source [%s]: %s", source.url, err)
+		}
+	}
+	return changed, nil
+}
+
+// With pin_on_first_use, the digest of the first version of a source that
+// was loaded is stored next to the cache file. It must be removed to accept
+// a different version.
+const SourceDigestPinSuffix = ".pin"
+
+// checkDigest logs the SHA-256 digest of the content of the source, and
+// compares it with the pinned digest, if any. A different digest is only
+// reported, as the content has a valid signature.
+func (source *Source) checkDigest(in string) {
+	digest := contentHash(in)
+	dlog.Infof("Source [%s] SHA-256: %s", source.url, digest)
+	if !source.fetchOptions.pinOnFirstUse || len(source.cacheFile) == 0 {
+		return
+	}
+	pinFile := source.cacheFile + SourceDigestPinSuffix
+	pin, err := SourcesCache.Read(pinFile)
+	if err != nil {
+		if err = SourcesCache.Write(pinFile, []byte(digest+"\n")); err != nil {
+			source.warnf("Unable to pin the digest of source [%s]: %s", source.url, err)
+			return
+		}
+		dlog.Noticef("Source [%s] pinned to SHA-256 digest %s", source.url, digest)
+		return
+	}
+	if pinned := strings.TrimFunc(string(pin), unicode.IsSpace); pinned != digest {
+		source.warnf("*** The content of source [%s] (SHA-256: %s) differs from the version pinned on first use (SHA-256: %s), even though it is signed. Remove [%s] to accept it ***", source.url, digest, pinned, pinFile)
+	}
+}
+
+func sameRegisteredServers(a []RegisteredServer, b []RegisteredServer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	stamps := make(map[string]string, len(a))
+	for _, registeredServer := range a {
+		stamps[registeredServer.name] = registeredServer.stamp.String()
+	}
+	for _, registeredServer := range b {
+		if stamp, ok := stamps[registeredServer.name]; !ok || stamp != registeredServer.stamp.String() {
+			return false
+		}
+	}
+	return true
+}
+
+func (source *Source) ParseRelays(prefix string) ([]RegisteredRelay, error) {
+	var registeredRelays []RegisteredRelay
+	registeredServers, err := source.Parse(prefix)
+	if err != nil {
+		return registeredRelays, err
+	}
+	for _, registeredServer := range registeredServers {
+		if registeredServer.stamp.proto != StampProtoTypeDNSCryptRelay {
+			return registeredRelays, fmt.Errorf("Stamp for [%s] in source from [%s] is not a relay stamp", registeredServer.name, source.url)
+		}
+		registeredRelays = append(registeredRelays, RegisteredRelay{name: registeredServer.name, stamp: registeredServer.stamp})
+	}
+	return registeredRelays, nil
+}
+
+// ParseResult is the content of a source, with the relays apart from the
+// resolvers, so that sources mixing both can be used.
+type ParseResult struct {
+	Resolvers []RegisteredServer
+	Relays    []RegisteredRelay
+	Warnings  []string
+}
+
+// ParseAll is like Parse, but also accepts relays, whatever the source is
+// declared to contain.
+func (source *Source) ParseAll(prefix string) (ParseResult, error) {
+	var result ParseResult
+	registeredServers, err := source.Parse(prefix)
+	if err != nil {
+		return result, err
+	}
+	for _, registeredServer := range registeredServers {
+		if registeredServer.stamp.proto == StampProtoTypeDNSCryptRelay {
+			result.Relays = append(result.Relays, RegisteredRelay{name: registeredServer.name, stamp: registeredServer.stamp})
+		} else {
+			result.Resolvers = append(result.Resolvers, registeredServer)
+		}
+	}
+	result.Warnings = source.Warnings()
+	return result, nil
+}
+
+func (source *Source) parseEntries(format SourceFormat, prefix string) ([]RegisteredServer, error) {
+	switch format {
+	case SourceFormatV1:
+		return source.parseV1(prefix)
+	case SourceFormatV2:
+		return source.parseV2(prefix)
+	case SourceFormatV3:
+		return source.parseV3(prefix)
+	}
+	dlog.Fatal("Unexpected source format")
+	return nil, nil
+}
+
+func (source *Source) parseFormat(format SourceFormat, prefix string) ([]RegisteredServer, error) {
+	registeredServers, err := source.parseEntries(format, prefix)
+	if err != nil {
+		return registeredServers, err
+	}
+	return source.removeDuplicateNames(registeredServers), nil
+}
+
+func (source *Source) removeDuplicateNames(registeredServers []RegisteredServer) []RegisteredServer {
+	seen := make(map[string]bool, len(registeredServers))
+	var uniqueServers []RegisteredServer
+	for _, registeredServer := range registeredServers {
+		if seen[registeredServer.name] {
+			dlog.Warnf("Duplicate server name [%s] in source from [%s] - only the first occurrence is used", registeredServer.name, source.url)
+			continue
+		}
+		seen[registeredServer.name] = true
+		uniqueServers = append(uniqueServers, registeredServer)
+	}
+	return uniqueServers
+}
+
+// removeDuplicateStamps merges servers registered by different sources that
+// share the same stamp, keeping the first name they were seen with. Stamps are
+// compared after decoding, so that encoding differences don't matter.
+func removeDuplicateStamps(registeredServers []RegisteredServer) []RegisteredServer {
+	seen := make(map[string]string, len(registeredServers))
+	var uniqueServers []RegisteredServer
+	for _, registeredServer := range registeredServers {
+		stampStr := canonicalStampString(registeredServer.stamp)
+		if name, found := seen[stampStr]; found {
+			dlog.Noticef("Server [%s] from source [%s] has the same stamp as [%s] - only [%s] is used", registeredServer.name, registeredServer.source, name, name)
+			continue
+		}
+		seen[stampStr] = registeredServer.name
+		uniqueServers = append(uniqueServers, registeredServer)
+	}
+	return uniqueServers
+}
+
+// sortRegisteredServers orders servers by name, then by stamp, so that the
+// merged list doesn't depend on the order in which the sources were loaded.
+func sortRegisteredServers(registeredServers []RegisteredServer) {
+	sort.SliceStable(registeredServers, func(i, j int) bool {
+		if registeredServers[i].name != registeredServers[j].name {
+			return registeredServers[i].name < registeredServers[j].name
+		}
+		return registeredServers[i].stamp.String() < registeredServers[j].stamp.String()
+	})
+}
+
+// normalizeSourceText removes a leading UTF-8 BOM and converts CRLF line
+// endings, so that files saved by Windows editors parse like Unix ones.
+func normalizeSourceText(in string) string {
+	return strings.Replace(strings.TrimPrefix(in, "\ufeff"), "\r\n", "\n", -1)
+}
+
+func detectSourceFormat(in string) (SourceFormat, error) {
+	in = normalizeSourceText(in)
+	if strings.HasPrefix(strings.TrimLeftFunc(in, unicode.IsSpace), "[") {
+		return SourceFormatV3, nil
+	}
+	firstLine := strings.TrimFunc(strings.SplitN(in, "\n", 2)[0], unicode.IsSpace)
+	looksLikeV1 := strings.Count(firstLine, ",") >= 13
+	looksLikeV2 := strings.HasPrefix(in, "## ") || strings.Contains(in, "\n## ")
+	if looksLikeV1 == looksLikeV2 {
+		return SourceFormatV1, errors.New("Unable to detect the source format")
+	}
+	if looksLikeV1 {
+		return SourceFormatV1, nil
+	}
+	return SourceFormatV2, nil
+}
+
+// requiredProperties returns the subset of requiredProps that servers from the
+// source can be checked for. v1 lists don't tell whether servers filter
+// responses, so NoFilter is not required from them.
+func (source *Source) requiredProperties(requiredProps ServerInformalProperties) ServerInformalProperties {
+	if source.format == SourceFormatV1 {
+		return requiredProps &^ ServerInformalPropertyNoFilter
+	}
+	return requiredProps
+}
+
+// SourcePrefixSourceName is replaced with the name of the source in prefixes
+const SourcePrefixSourceName = "{source}"
+
+func (source *Source) Parse(prefix string) ([]RegisteredServer, error) {
+	prefix = strings.Replace(prefix, SourcePrefixSourceName, source.name, -1)
+	registeredServers, err := source.parseFormat(source.format, prefix)
+	if source.formatFallback && source.format != SourceFormatV3 && (err != nil || len(registeredServers) == 0) {
+		fallbackFormat := SourceFormat(SourceFormatV2)
+		if source.format == SourceFormatV2 {
+			fallbackFormat = SourceFormatV1
+		}
+		fallbackServers, fallbackErr := source.parseFormat(fallbackFormat, prefix)
+		if fallbackErr == nil && len(fallbackServers) > 0 {
+			dlog.Noticef("Source [%s] could not be parsed as format v%d, but was successfully parsed as format v%d", source.url, source.format+1, fallbackFormat+1)
+			registeredServers, err = fallbackServers, nil
+		}
+	}
+	if err == nil && source.stampTransformer != nil {
+		registeredServers = source.transformStamps(registeredServers)
+	}
+	for i := range registeredServers {
+		source.finishRegisteredServer(&registeredServers[i])
+	}
+	if err == nil && !source.allowPrivate {
+		registeredServers, err = source.removePrivateAddrs(registeredServers)
+	}
+	if err == nil {
+		registeredServers = source.filterAddressFamily(registeredServers)
+	}
+	if err == nil {
+		source.serverCount = len(registeredServers)
+	}
+	return registeredServers, err
+}
+
+var privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrivateAddr rejects servers whose address is a loopback, private or
+// link-local IP address. Host names are not resolved.
+func (source *Source) checkPrivateAddr(registeredServer *RegisteredServer) *SourceParseError {
+	ip := net.ParseIP(registeredServer.host)
+	if ip == nil || !isPrivateIP(ip) {
+		return nil
+	}
+	return &SourceParseError{url: source.url, server: registeredServer.name, message: fmt.Sprintf("Non-public address [%s]", registeredServer.host)}
+}
+
+func (source *Source) removePrivateAddrs(registeredServers []RegisteredServer) ([]RegisteredServer, error) {
+	var publicServers []RegisteredServer
+	for i := range registeredServers {
+		if parseErr := source.checkPrivateAddr(&registeredServers[i]); parseErr != nil {
+			if !source.lenient {
+				return registeredServers, parseErr
+			}
+			dlog.Warnf("Ignoring server [%s] from source [%s]: non-public address [%s]", registeredServers[i].name, source.url, registeredServers[i].host)
+			continue
+		}
+		publicServers = append(publicServers, registeredServers[i])
+	}
+	return publicServers, nil
+}
+
+// Address families a source can be restricted to
+const (
+	SourceAddressFamilyBoth = "both"
+	SourceAddressFamilyIPv4 = "ipv4only"
+	SourceAddressFamilyIPv6 = "ipv6only"
+)
+
+// filterAddressFamily drops the servers that have no stamp reachable over the
+// address family of the source. Servers whose stamps use host names are kept,
+// unless resolveHosts is set and none of their addresses match.
+func (source *Source) filterAddressFamily(registeredServers []RegisteredServer) []RegisteredServer {
+	if len(source.addressFamily) == 0 || source.addressFamily == SourceAddressFamilyBoth {
+		return registeredServers
+	}
+	var reachableServers []RegisteredServer
+	for i := range registeredServers {
+		if source.isReachable(&registeredServers[i]) {
+			reachableServers = append(reachableServers, registeredServers[i])
+		}
+	}
+	if filtered := len(registeredServers) - len(reachableServers); filtered > 0 {
+		dlog.Noticef("Ignoring %d servers from source [%s] that are not reachable with %s", filtered, source.url, source.addressFamily)
+	}
+	return reachableServers
+}
+
+func (source *Source) isReachable(registeredServer *RegisteredServer) bool {
+	if len(source.addressFamily) == 0 || source.addressFamily == SourceAddressFamilyBoth {
+		return true
+	}
+	return source.hasAddressFamily(registeredServer, source.addressFamily == SourceAddressFamilyIPv6)
+}
+
+// hasAddressFamily only checks the primary stamp, which is the one used to
+// connect to the server. Host names are resolved with the bootstrap resolver
+// of the source.
+func (source *Source) hasAddressFamily(registeredServer *RegisteredServer, wantIPv6 bool) bool {
+	host := registeredServer.host
+	if len(host) == 0 {
+		stampServer := RegisteredServer{stamp: registeredServer.stamp}
+		stampServer.decodeStamp()
+		host = stampServer.host
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if !source.resolveHosts {
+			return true
+		}
+		resolver, err := source.fetchOptions.resolver()
+		if err != nil {
+			dlog.Debugf("Unable to resolve [%s] for server [%s]: %s", host, registeredServer.name, err)
+			return true
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), SourceResolveTimeout)
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			dlog.Debugf("Unable to resolve [%s] for server [%s]: %s", host, registeredServer.name, err)
+			return true
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if (ip.To4() == nil) == wantIPv6 {
+			return true
+		}
+	}
+	return false
+}
+
+func (source *Source) finishRegisteredServer(registeredServer *RegisteredServer) {
+	registeredServer.source = source.name
+	if len(registeredServer.source) == 0 {
+		registeredServer.source = source.url
+	}
+	if len(registeredServer.stamps) == 0 {
+		registeredServer.stamps = []ServerStamp{registeredServer.stamp}
+	} else {
+		registeredServer.stamps[0] = registeredServer.stamp
+	}
+	registeredServer.decodeStamp()
+}
+
+func (source *Source) transformStamps(registeredServers []RegisteredServer) []RegisteredServer {
+	var transformedServers []RegisteredServer
+	for _, registeredServer := range registeredServers {
+		stamp, keep := source.stampTransformer(registeredServer.name, registeredServer.stamp)
+		if !keep {
+			dlog.Debugf("Stamp transformer dropped [%s]", registeredServer.name)
+			continue
+		}
+		registeredServer.stamp = stamp
+		transformedServers = append(transformedServers, registeredServer)
+	}
+	return transformedServers
+}
+
+func (err *SourceParseError) skippedEntry() string {
+	if len(err.server) == 0 && err.block > 0 {
+		return fmt.Sprintf("[block %d, line %d]: %s", err.block, err.line, err.message)
+	}
+	return fmt.Sprintf("[%s]: %s", err.server, err.message)
+}
+
+func (source *Source) logSkippedEntries(skippedEntries []string) {
+	if len(skippedEntries) == 0 {
+		return
+	}
+	source.warnf("%d invalid entries skipped in source from [%s]:\n%s", len(skippedEntries), source.url, strings.Join(skippedEntries, "\n"))
+}
+
+// warnf logs a problem that doesn't prevent the source from being used, and
+// keeps it for Warnings. Repeated problems are only kept once.
+func (source *Source) warnf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	dlog.Warn(message)
+	for _, warning := range source.warnings {
+		if warning == message {
+			return
+		}
+	}
+	source.warnings = append(source.warnings, message)
+}
+
+// Warnings returns the problems found while loading and parsing the source
+// that didn't prevent it from being used.
+func (source *Source) Warnings() []string {
+	return source.warnings
+}
+
+// SourceParseError describes an invalid entry in a source. line, column,
+// field and block are 1-based, and 0 when unknown. field is only set for v1
+// sources, block for v2 blocks without a name, server for v2 blocks whose
+// name could be read.
+type SourceParseError struct {
+	url     string
+	line    int
+	column  int
+	field   int
+	block   int
+	server  string
+	message string
+}
+
+func (err *SourceParseError) Error() string {
+	var position []string
+	if err.line > 0 {
+		position = append(position, fmt.Sprintf("line %d", err.line))
+	}
+	if err.column > 0 {
+		position = append(position, fmt.Sprintf("column %d", err.column))
+	}
+	if err.field > 0 {
+		position = append(position, fmt.Sprintf("field %d", err.field))
+	}
+	if err.block > 0 {
+		position = append(position, fmt.Sprintf("block %d", err.block))
+	}
+	if len(err.server) > 0 {
+		position = append(position, fmt.Sprintf("server [%s]", err.server))
+	}
+	if len(position) == 0 {
+		return fmt.Sprintf("Parse error in source from [%s]: %s", err.url, err.message)
+	}
+	return fmt.Sprintf("Parse error in source from [%s] at %s: %s", err.url, strings.Join(position, ", "), err.message)
+}
+
+func validateLegacyPublicKey(serverPkStr string) error {
+	if strings.IndexFunc(serverPkStr, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("Public key [%s] contains spaces", serverPkStr)
+	}
+	hexStr := strings.Replace(serverPkStr, ":", "", -1)
+	if len(hexStr) != 2*ed25519.PublicKeySize {
+		return fmt.Errorf("Public key [%s] has %d hex digits instead of %d", serverPkStr, len(hexStr), 2*ed25519.PublicKeySize)
+	}
+	if _, err := hex.DecodeString(hexStr); err != nil {
+		return fmt.Errorf("Public key [%s] is not valid hex", serverPkStr)
+	}
+	return nil
+}
+
+// validateLegacyServerAddr checks that addr is an IP address or a host name,
+// optionally followed by a port. Bare IPv6 addresses are accepted, and are
+// bracketed when the stamp is built.
+func validateLegacyServerAddr(addr string) error {
+	if net.ParseIP(addr) != nil {
+		return nil
+	}
+	host, portStr := addr, ""
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		host = addr[1 : len(addr)-1]
+	} else if strings.IndexByte(addr, ':') >= 0 {
+		var err error
+		if host, portStr, err = net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Invalid server address [%s]", addr)
+		}
+		if len(portStr) == 0 {
+			return fmt.Errorf("Missing port in server address [%s]", addr)
+		}
+		if port, err := strconv.Atoi(portStr); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("Invalid port [%s] in server address [%s]", portStr, addr)
+		}
+	}
+	if strings.HasPrefix(addr, "[") {
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("Invalid IPv6 address in server address [%s]", addr)
+		}
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		if strings.IndexByte(host, ':') >= 0 {
+			return fmt.Errorf("IPv6 address [%s] must be enclosed in brackets when a port is given", host)
+		}
+		return nil
+	}
+	if !isValidHostName(host) {
+		return fmt.Errorf("Invalid host name [%s] in server address [%s]", host, addr)
+	}
+	return nil
+}
+
+func isValidHostName(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (source *Source) parseV1(prefix string) ([]RegisteredServer, error) {
+	var registeredServers []RegisteredServer
+	var skippedEntries []string
+
+	csvReader := csv.NewReader(strings.NewReader(source.in))
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		if csvErr, ok := err.(*csv.ParseError); ok {
+			return registeredServers, &SourceParseError{url: source.url, line: csvErr.Line, column: csvErr.Column, message: csvErr.Err.Error()}
+		}
+		return registeredServers, err
+	}
+	for lineNo, record := range records {
+		if len(record) == 0 {
+			continue
+		}
+		if len(record) < 14 {
+			return registeredServers, &SourceParseError{url: source.url, line: 1 + lineNo, message: fmt.Sprintf("Expected at least 14 fields, found %d", len(record))}
+		}
+		if lineNo == 0 {
+			continue
+		}
+		name := prefix + record[0]
+		serverAddrStr := record[10]
+		providerName := record[11]
+		serverPkStr := record[12]
+		props := ServerInformalProperties(0)
+		if strings.EqualFold(record[7], "yes") {
+			props |= ServerInformalPropertyDNSSEC
+		}
+		if strings.EqualFold(record[8], "yes") {
+			props |= ServerInformalPropertyNoLog
+		}
+		if err := validateLegacyPublicKey(serverPkStr); err != nil {
+			if !source.lenient {
+				return registeredServers, &SourceParseError{url: source.url, line: 1 + lineNo, field: 13, server: name, message: err.Error()}
+			}
+			skippedEntries = append(skippedEntries, fmt.Sprintf("Line %d [%s]: %s", 1+lineNo, name, err))
+			continue
+		}
+		serverAddrStr, err := normalizeServerAddr(serverAddrStr)
+		if err == nil {
+			err = validateLegacyServerAddr(serverAddrStr)
+		}
+		if err != nil {
+			if !source.lenient {
+				return registeredServers, &SourceParseError{url: source.url, line: 1 + lineNo, field: 11, server: name, message: err.Error()}
+			}
+			skippedEntries = append(skippedEntries, fmt.Sprintf("Line %d [%s]: %s", 1+lineNo, name, err))
+			continue
+		}
+		stamp, err := NewDNSCryptServerStampFromLegacy(serverAddrStr, serverPkStr, providerName, props)
+		if err != nil {
+			if !source.lenient {
+				return registeredServers, &SourceParseError{url: source.url, line: 1 + lineNo, field: 13, server: name, message: err.Error()}
+			}
+			skippedEntries = append(skippedEntries, fmt.Sprintf("Line %d [%s]: %s", 1+lineNo, name, err))
+			continue
+		}
+		registeredServer := RegisteredServer{
+			name: name, stamp: stamp,
+		}
+		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
+		registeredServers = append(registeredServers, registeredServer)
+	}
+	source.logSkippedEntries(skippedEntries)
+	return registeredServers, nil
+}
+
+func (source *Source) parseV2(prefix string) ([]RegisteredServer, error) {
+	var registeredServers []RegisteredServer
+	var skippedEntries []string
+	err := source.splitV2Blocks(strings.NewReader(source.in), func(block string, blockIndex int, blockLineNo int) error {
+		registeredServer, skippable, parseErr := source.parseV2Block(block, blockIndex, blockLineNo, prefix)
+		if parseErr != nil {
+			if !skippable || !source.lenient {
+				return parseErr
+			}
+			skippedEntries = append(skippedEntries, parseErr.skippedEntry())
+			return nil
+		}
+		registeredServers = append(registeredServers, registeredServer)
+		return nil
+	})
+	if err != nil {
+		return registeredServers, err
+	}
+	source.logSkippedEntries(skippedEntries)
+	return registeredServers, nil
+}
+
+// splitV2Blocks reads a v2 source from r, and calls fn for every block, along
+// with its index and the line it starts at. Blocks start with a line beginning
+// with "## ". The lines before the first one can only declare the format
+// version. Parsing stops at the first error returned by fn.
+func (source *Source) splitV2Blocks(r io.Reader, fn func(block string, blockIndex int, blockLineNo int) error) error {
+	var block bytes.Buffer
+	blockIndex, blockLineNo := 0, 0
+	flush := func() error {
+		if blockIndex == 0 {
+			return nil
+		}
+		err := fn(block.String(), blockIndex, blockLineNo)
+		block.Reset()
+		return err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, int(DefaultSourceMaxSize))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if lineNo == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if strings.HasPrefix(line, "## ") {
+			if err := flush(); err != nil {
+				return err
+			}
+			blockIndex, blockLineNo = blockIndex+1, lineNo
+			line = line[3:]
+		}
+		if blockIndex > 0 {
+			block.WriteString(line)
+			block.WriteByte('\n')
+		} else if parseErr := source.checkFormatVersion(line, lineNo); parseErr != nil {
+			return parseErr
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if blockIndex == 0 {
+		return &SourceParseError{url: source.url, message: "No server entries found"}
+	}
+	return flush()
+}
+
+// A v2 source can declare the revision of the format it uses with a line such
+// as "format_version: 2" before its first entry. Sources without it are
+// assumed to be compatible.
+const (
+	SourceFormatVersionHeader    = "format_version:"
+	MaxSupportedSourceV2Revision = 2
+)
+
+func (source *Source) checkFormatVersion(line string, lineNo int) *SourceParseError {
+	line = strings.TrimFunc(line, unicode.IsSpace)
+	if !strings.HasPrefix(line, SourceFormatVersionHeader) {
+		return nil
+	}
+	versionStr := strings.TrimPrefix(strings.TrimFunc(line[len(SourceFormatVersionHeader):], unicode.IsSpace), "v")
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		return &SourceParseError{url: source.url, line: lineNo, message: fmt.Sprintf("Invalid format version [%s]", versionStr)}
+	}
+	if version > MaxSupportedSourceV2Revision {
+		return &SourceParseError{url: source.url, line: lineNo, message: fmt.Sprintf("Source requires format v%d, this build supports up to v%d", version, MaxSupportedSourceV2Revision)}
+	}
+	return nil
+}
+
+// parseV2Block parses the text following the blockIndex-th "## " marker.
+// skippable is true if the error only affects this entry, which can then be
+// skipped in lenient mode.
+func (source *Source) parseV2Block(part string, blockIndex int, blockLineNo int, prefix string) (RegisteredServer, bool, *SourceParseError) {
+	firstLine := part
+	if eol := strings.IndexByte(part, '\n'); eol >= 0 {
+		firstLine = part[:eol]
+	}
+	if len(strings.TrimFunc(firstLine, unicode.IsSpace)) == 0 {
+		return RegisteredServer{}, true, &SourceParseError{url: source.url, line: blockLineNo, block: blockIndex, message: "Missing server name"}
+	}
+	part = strings.TrimFunc(part, unicode.IsSpace)
+	subparts := strings.Split(part, "\n")
+	name := strings.TrimFunc(subparts[0], unicode.IsSpace)
+	name = prefix + name
+	if len(subparts) < 2 {
+		return RegisteredServer{}, true, &SourceParseError{url: source.url, line: blockLineNo, server: name, message: "Missing stamp"}
+	}
+	var stamps []ServerStamp
+	var descriptionLines []string
+	var relayHints []RelayHint
+	for i, subpart := range subparts[1:] {
+		subpart = strings.TrimFunc(subpart, unicode.IsSpace)
+		if !strings.HasPrefix(subpart, "sdns://") {
+			if relayHint, ok := parseRelayHint(subpart); ok {
+				relayHints = append(relayHints, relayHint)
+			}
+			if len(stamps) == 0 {
+				descriptionLines = append(descriptionLines, subpart)
+			}
+			continue
+		}
+		if len(subpart) < 8 {
+			continue
+		}
+		stamp, err := NewServerStampFromString(subpart)
+		if err != nil {
+			return RegisteredServer{}, true, &SourceParseError{url: source.url, line: blockLineNo + 1 + i, server: name, message: err.Error()}
+		}
+		stamps = append(stamps, stamp)
+	}
+	if len(stamps) == 0 {
+		return RegisteredServer{}, true, &SourceParseError{url: source.url, line: blockLineNo, server: name, message: "Missing stamp"}
+	}
+	stamp := stamps[0]
+	registeredServer := RegisteredServer{
+		name: name, stamp: stamp, stamps: stamps,
+		description: strings.TrimFunc(strings.Join(descriptionLines, "\n"), unicode.IsSpace),
+		relayHints:  relayHints,
+	}
+	dlog.Debugf("Registered [%s] with stamp [%s] (%d stamps)", name, stamp.String(), len(stamps))
+	return registeredServer, false, nil
+}
+
+// parseRelayHint recognizes the "relay: sdns://..." and "via: name" lines of
+// a description. Other lines, and relay stamps that cannot be decoded, are
+// not hints.
+func parseRelayHint(line string) (RelayHint, bool) {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return RelayHint{}, false
+	}
+	key := strings.ToLower(strings.TrimFunc(line[:colon], unicode.IsSpace))
+	value := strings.TrimFunc(line[colon+1:], unicode.IsSpace)
+	if len(value) == 0 {
+		return RelayHint{}, false
+	}
+	switch key {
+	case "relay":
+		stamp, err := NewServerStampFromString(value)
+		if err != nil || stamp.proto != StampProtoTypeDNSCryptRelay {
+			dlog.Debugf("Ignoring relay hint [%s]", value)
+			return RelayHint{}, false
+		}
+		return RelayHint{Stamp: stamp.String()}, true
+	case "via":
+		return RelayHint{Name: value}, true
+	}
+	return RelayHint{}, false
+}
+
+// ParseStream parses a v2 source read from r one block at a time, and calls fn
+// for every server instead of building the complete list, so that large
+// sources can be processed with little memory. Servers are filtered like with
+// Parse. Parsing stops at the first error returned by fn.
+func (source *Source) ParseStream(r io.Reader, prefix string, fn func(RegisteredServer) error) error {
+	if source.format != SourceFormatV2 {
+		return fmt.Errorf("Source at [%s] cannot be streamed - only the v2 format can", source.url)
+	}
+	prefix = strings.Replace(prefix, SourcePrefixSourceName, source.name, -1)
+	seen := make(map[string]bool)
+	var skippedEntries []string
+	count := 0
+	err := source.splitV2Blocks(r, func(block string, blockIndex int, blockLineNo int) error {
+		registeredServer, skippable, parseErr := source.parseV2Block(block, blockIndex, blockLineNo, prefix)
+		if parseErr != nil {
+			if !skippable || !source.lenient {
+				return parseErr
+			}
+			skippedEntries = append(skippedEntries, parseErr.skippedEntry())
+			return nil
+		}
+		registeredServers := []RegisteredServer{registeredServer}
+		if source.stampTransformer != nil {
+			if registeredServers = source.transformStamps(registeredServers); len(registeredServers) == 0 {
+				return nil
+			}
+		}
+		registeredServer = registeredServers[0]
+		if seen[registeredServer.name] {
+			dlog.Warnf("Duplicate server name [%s] in source from [%s] - only the first occurrence is used", registeredServer.name, source.url)
+			return nil
+		}
+		seen[registeredServer.name] = true
+		source.finishRegisteredServer(&registeredServer)
+		if !source.allowPrivate {
+			if parseErr := source.checkPrivateAddr(&registeredServer); parseErr != nil {
+				if !source.lenient {
+					return parseErr
+				}
+				dlog.Warnf("Ignoring server [%s] from source [%s]: non-public address [%s]", registeredServer.name, source.url, registeredServer.host)
+				return nil
+			}
+		}
+		if !source.isReachable(&registeredServer) {
+			dlog.Debugf("Ignoring server [%s] from source [%s] that is not reachable with %s", registeredServer.name, source.url, source.addressFamily)
+			return nil
+		}
+		count++
+		return fn(registeredServer)
+	})
+	if err != nil {
+		return err
+	}
+	source.logSkippedEntries(skippedEntries)
+	source.serverCount = count
+	return nil
+}
+
+type sourceV3Entry struct {
+	Name        string `json:"name"`
+	Stamp       string `json:"stamp"`
+	Description string `json:"description"`
+	Properties  *struct {
+		DNSSEC   bool `json:"dnssec"`
+		NoLog    bool `json:"nolog"`
+		NoFilter bool `json:"nofilter"`
+	} `json:"properties"`
+}
+
+func (source *Source) parseV3(prefix string) ([]RegisteredServer, error) {
+	var registeredServers []RegisteredServer
+	var skippedEntries []string
+	in := strings.TrimPrefix(source.in, "\ufeff")
+	var entries []sourceV3Entry
+	if err := json.Unmarshal([]byte(in), &entries); err != nil {
+		parseErr := &SourceParseError{url: source.url, message: err.Error()}
+		if syntaxErr, ok := err.(*json.SyntaxError); ok && syntaxErr.Offset <= int64(len(in)) {
+			parseErr.line = 1 + strings.Count(in[:syntaxErr.Offset], "\n")
+		}
+		return registeredServers, parseErr
+	}
+	for i, entry := range entries {
+		name := strings.TrimFunc(entry.Name, unicode.IsSpace)
+		if len(name) == 0 {
+			if !source.lenient {
+				return registeredServers, &SourceParseError{url: source.url, message: fmt.Sprintf("Missing server name in entry #%d", i+1)}
+			}
+			skippedEntries = append(skippedEntries, fmt.Sprintf("Entry #%d: missing name", i+1))
+			continue
+		}
+		name = prefix + name
+		stamp, err := NewServerStampFromString(strings.TrimFunc(entry.Stamp, unicode.IsSpace))
+		if err != nil {
+			if !source.lenient {
+				return registeredServers, &SourceParseError{url: source.url, server: name, message: err.Error()}
+			}
+			skippedEntries = append(skippedEntries, fmt.Sprintf("[%s]: %s", name, err))
+			continue
+		}
+		if entry.Properties != nil && stamp.proto != StampProtoTypeDNSCryptRelay {
+			stamp.props = ServerInformalProperties(0)
+			if entry.Properties.DNSSEC {
+				stamp.props |= ServerInformalPropertyDNSSEC
+			}
+			if entry.Properties.NoLog {
+				stamp.props |= ServerInformalPropertyNoLog
+			}
+			if entry.Properties.NoFilter {
+				stamp.props |= ServerInformalPropertyNoFilter
+			}
+		}
+		registeredServer := RegisteredServer{
+			name: name, stamp: stamp,
+			description: strings.TrimFunc(entry.Description, unicode.IsSpace),
+		}
+		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
+		registeredServers = append(registeredServers, registeredServer)
+	}
+	source.logSkippedEntries(skippedEntries)
+	return registeredServers, nil
+}
+
+var SourceCacheSidecarSuffixes = []string{".minisig", ".serial", ".ttl", ".etag", SourceNegativeCacheSuffix, ".part", ".validator", SourceContentHashSuffix, SourceDigestPinSuffix, SourceLastKnownGoodSuffix, SourceTimestampSuffix}
+
+// sidecarBase strips all the sidecar suffixes of a file name, so that
+// "x.good.minisig" and "x.minisig.etag" both belong to "x".
+func sidecarBase(file string) (string, bool) {
+	base, matched := file, false
+	for stripped := true; stripped; {
+		stripped = false
+		for _, suffix := range SourceCacheSidecarSuffixes {
+			if strings.HasSuffix(base, suffix) && len(base) > len(suffix) {
+				base = strings.TrimSuffix(base, suffix)
+				matched, stripped = true, true
+				break
+			}
+		}
+	}
+	return base, matched
+}
+
+// Compact removes the sidecar files of cacheDir, such as signatures and
+// metadata, whose cache file is not in activeCacheFiles. Only file names
+// ending with one of SourceCacheSidecarSuffixes are considered, so unrelated
+// files and the cache files themselves are never removed. With dryRun, files
+// are only listed.
+func Compact(cacheDir string, activeCacheFiles []string, dryRun bool) ([]string, error) {
+	active := make(map[string]bool, len(activeCacheFiles))
+	for _, cacheFile := range activeCacheFiles {
+		if absCacheFile, err := filepath.Abs(cacheFile); err == nil {
+			active[absCacheFile] = true
+		}
+	}
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		file, err := filepath.Abs(filepath.Join(cacheDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		cacheFile, matched := sidecarBase(file)
+		if !matched || active[cacheFile] || active[file] {
+			continue
+		}
+		orphans = append(orphans, file)
+	}
+	var removed []string
+	for _, file := range orphans {
+		if dryRun {
+			dlog.Noticef("Would remove orphaned cache file [%s]", file)
+		} else if err := os.Remove(file); err != nil {
+			dlog.Warnf("%s: %s", file, err)
+			continue
+		} else {
+			dlog.Noticef("Removed orphaned cache file [%s]", file)
+		}
+		removed = append(removed, file)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// ValidateSourceFile parses a local source file exactly like the proxy would,
+// without fetching or verifying anything, and reports suspicious entries.
+// The source is read from the standard input if path is "-".
+func ValidateSourceFile(path string, formatStr string) ([]RegisteredServer, []string, error) {
+	var warnings []string
+	var bin []byte
+	var err error
+	if path == StdinSourceURL {
+		bin, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bin, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, warnings, err
+	}
+	source := Source{url: path, in: string(bin)}
+	if formatStr == "auto" {
+		source.format, err = detectSourceFormat(source.in)
+	} else {
+		source.format, err = sourceFormatFromString(formatStr)
+	}
+	if err != nil {
+		return nil, warnings, err
+	}
+	registeredServers, err := source.parseEntries(source.format, "")
+	if err != nil {
+		return nil, warnings, err
+	}
+	seen := make(map[string]bool, len(registeredServers))
+	for _, registeredServer := range registeredServers {
+		if seen[registeredServer.name] {
+			warnings = append(warnings, fmt.Sprintf("[%s]: duplicate name", registeredServer.name))
+		}
+		seen[registeredServer.name] = true
+		if source.format != SourceFormatV1 && len(registeredServer.description) == 0 {
+			warnings = append(warnings, fmt.Sprintf("[%s]: empty description", registeredServer.name))
+		}
+		host, _, err := net.SplitHostPort(registeredServer.stamp.serverAddrStr)
+		if err != nil {
+			host = registeredServer.stamp.serverAddrStr
+		}
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) {
+			warnings = append(warnings, fmt.Sprintf("[%s]: the stamp points to a local address [%s]", registeredServer.name, registeredServer.stamp.serverAddrStr))
+		}
+	}
+	return source.removeDuplicateNames(registeredServers), warnings, nil
+}
+
+type SourceLoadResult struct {
+	name           string
+	source         Source
+	urlsToPrefetch []URLToPrefetch
+	err            error
+}
+
+// LoadSources loads the named sources concurrently, using at most
+// MaxConcurrentSourceLoads workers. Results are returned in the order of the
+// names, and a failing source doesn't prevent the others from being loaded.
+func (config *Config) LoadSources(ctx context.Context, names []string) []SourceLoadResult {
+	results := make([]SourceLoadResult, len(names))
+	workers := make(chan struct{}, MaxConcurrentSourceLoads)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			cfgSource := config.SourcesConfig[name]
+			source, urlsToPrefetch, err := config.newSource(ctx, name, &cfgSource)
+			results[i] = SourceLoadResult{name: name, source: source, urlsToPrefetch: urlsToPrefetch, err: err}
+		}(i, name)
+	}
+	wg.Wait()
+	return results
+}
+
+func (config *Config) sourceNames() []string {
+	names := make([]string, 0, len(config.SourcesConfig))
+	for name := range config.SourcesConfig {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PrewarmCaches loads all the sources into their cache files, after checking
+// the configuration exactly like when the proxy starts.
+func PrewarmCaches(config *Config) (map[string]error, error) {
+	if err := config.applySourcesConfig(); err != nil {
+		return nil, err
+	}
+	report := make(map[string]error, len(config.SourcesConfig))
+	for _, result := range config.LoadSources(context.Background(), config.sourceNames()) {
+		report[result.name] = result.err
+	}
+	return report, nil
+}
+
+// sourcesCacheFiles returns the cache files of the configured sources, and the
+// directories they are stored in.
+func (config *Config) sourcesCacheFiles() (activeCacheFiles []string, cacheDirs []string) {
+	seenDirs := make(map[string]bool)
+	for _, cfgSource := range config.SourcesConfig {
+		if _, isLocal := localSourcePath(cfgSource.URL); isLocal || len(cfgSource.CacheFile) == 0 {
+			continue
+		}
+		cacheFile, sigCacheFile := SourcesCacheNamer(cfgSource.URL, cfgSource.CacheFile)
+		activeCacheFiles = append(activeCacheFiles, cacheFile, sigCacheFile)
+		for _, file := range []string{cacheFile, sigCacheFile} {
+			if dir := filepath.Dir(file); !seenDirs[dir] {
+				seenDirs[dir] = true
+				cacheDirs = append(cacheDirs, dir)
+			}
+		}
+	}
+	return activeCacheFiles, cacheDirs
+}
+
+type ServersBlacklist struct {
+	stamps map[string]bool
+	keys   map[string]bool
+}
+
+func LoadServersBlacklist(file string) (*ServersBlacklist, error) {
+	dlog.Noticef("Loading the servers blacklist from [%s]", file)
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	blacklist := ServersBlacklist{stamps: make(map[string]bool), keys: make(map[string]bool)}
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) >= 7 && strings.EqualFold(line[:7], "sdns://") {
+			stampStr, err := CanonicalStamp(line)
+			if err != nil {
+				dlog.Errorf("Invalid stamp in the servers blacklist at line %d", 1+lineNo)
+				continue
+			}
+			blacklist.stamps[stampStr] = true
+			continue
+		}
+		key, err := hex.DecodeString(strings.Replace(line, ":", "", -1))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			dlog.Errorf("Invalid public key in the servers blacklist at line %d", 1+lineNo)
+			continue
+		}
+		blacklist.keys[hex.EncodeToString(key)] = true
+	}
+	return &blacklist, nil
+}
+
+func (blacklist *ServersBlacklist) Filter(sourceName string, registeredServers []RegisteredServer) []RegisteredServer {
+	var filteredServers []RegisteredServer
+	for _, registeredServer := range registeredServers {
+		if blacklist.stamps[canonicalStampString(registeredServer.stamp)] {
+			dlog.Noticef("Source [%s]: server [%s] removed - its stamp is blacklisted", sourceName, registeredServer.name)
+			continue
+		}
+		if len(registeredServer.stamp.serverPk) > 0 && blacklist.keys[hex.EncodeToString(registeredServer.stamp.serverPk)] {
+			dlog.Noticef("Source [%s]: server [%s] removed - its public key is blacklisted", sourceName, registeredServer.name)
+			continue
+		}
+		filteredServers = append(filteredServers, registeredServer)
+	}
+	return filteredServers
+}
+
+// serverOverride is the set of changes to apply to the servers with a given
+// name, from the servers override file.
+type serverOverride struct {
+	remove     bool
+	stamp      *ServerStamp
+	rename     string
+	setProps   ServerInformalProperties
+	clearProps ServerInformalProperties
+	lineNo     int
+	used       bool
+}
+
+// ServersOverrides is a local, unsigned file applied to the servers of all
+// the sources, one "<server name> <action> [argument]" line per change:
+//
+//	example-server remove
+//	example-server stamp sdns://...
+//	example-server rename my-server
+//	example-server props +dnssec -nofilter
+type ServersOverrides struct {
+	overrides map[string]*serverOverride
+}
+
+var serverOverrideProps = map[string]ServerInformalProperties{
+	"dnssec":   ServerInformalPropertyDNSSEC,
+	"nolog":    ServerInformalPropertyNoLog,
+	"nofilter": ServerInformalPropertyNoFilter,
+}
+
+func LoadServersOverrides(file string) (*ServersOverrides, error) {
+	dlog.Noticef("Loading the servers overrides from [%s]", file)
+	bin, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	overrides := ServersOverrides{overrides: make(map[string]*serverOverride)}
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			dlog.Errorf("Missing action in the servers overrides at line %d", 1+lineNo)
+			continue
+		}
+		name, action, args := fields[0], fields[1], fields[2:]
+		override, ok := overrides.overrides[name]
+		if !ok {
+			override = &serverOverride{lineNo: 1 + lineNo}
+			overrides.overrides[name] = override
+		}
+		switch action {
+		case "remove":
+			override.remove = true
+		case "stamp":
+			if len(args) != 1 {
+				dlog.Errorf("Expected a single stamp in the servers overrides at line %d", 1+lineNo)
+				continue
+			}
+			stamp, err := NewServerStampFromString(args[0])
+			if err != nil {
+				dlog.Errorf("Invalid stamp in the servers overrides at line %d", 1+lineNo)
+				continue
+			}
+			if override.stamp != nil {
+				dlog.Warnf("Server [%s] has several stamp overrides - using the one at line %d", name, 1+lineNo)
+			}
+			override.stamp = &stamp
+		case "rename":
+			if len(args) != 1 {
+				dlog.Errorf("Expected a single name in the servers overrides at line %d", 1+lineNo)
+				continue
+			}
+			if len(override.rename) > 0 {
+				dlog.Warnf("Server [%s] is renamed several times - using the name at line %d", name, 1+lineNo)
+			}
+			override.rename = args[0]
+		case "props":
+			for _, arg := range args {
+				prop, ok := serverOverrideProps[strings.TrimLeft(arg, "+-")]
+				if !ok {
+					dlog.Errorf("Unknown property [%s] in the servers overrides at line %d", arg, 1+lineNo)
+					continue
+				}
+				if strings.HasPrefix(arg, "-") {
+					override.setProps &^= prop
+					override.clearProps |= prop
+				} else {
+					override.clearProps &^= prop
+					override.setProps |= prop
+				}
+			}
+		default:
+			dlog.Errorf("Unknown action [%s] in the servers overrides at line %d", action, 1+lineNo)
+		}
+	}
+	for name, override := range overrides.overrides {
+		if override.remove && (override.stamp != nil || len(override.rename) > 0 || override.setProps|override.clearProps != 0) {
+			dlog.Warnf("Server [%s] is both removed and modified in the servers overrides - it will be removed", name)
+		}
+	}
+	return &overrides, nil
+}
+
+// Apply changes the servers of a source according to the overrides, by name.
+func (overrides *ServersOverrides) Apply(sourceName string, registeredServers []RegisteredServer) []RegisteredServer {
+	var overriddenServers []RegisteredServer
+	for _, registeredServer := range registeredServers {
+		override, ok := overrides.overrides[registeredServer.name]
+		if !ok {
+			overriddenServers = append(overriddenServers, registeredServer)
+			continue
+		}
+		if override.used {
+			dlog.Warnf("Source [%s]: server [%s] was already overridden in another source - overriding it again", sourceName, registeredServer.name)
+		}
+		override.used = true
+		if override.remove {
+			dlog.Noticef("Source [%s]: server [%s] removed by the servers overrides", sourceName, registeredServer.name)
+			continue
+		}
+		if override.stamp != nil {
+			registeredServer.stamp = *override.stamp
+			registeredServer.stamps = []ServerStamp{registeredServer.stamp}
+		}
+		registeredServer.stamp.props = (registeredServer.stamp.props | override.setProps) &^ override.clearProps
+		if len(override.rename) > 0 {
+			registeredServer.name = override.rename
+		}
+		registeredServer.decodeStamp()
+		dlog.Noticef("Source [%s]: server [%s] modified by the servers overrides", sourceName, registeredServer.name)
+		overriddenServers = append(overriddenServers, registeredServer)
+	}
+	return overriddenServers
+}
+
+// LogUnused warns about the overrides that didn't match any server, usually
+// because the server was renamed or removed upstream.
+func (overrides *ServersOverrides) LogUnused() {
+	for name, override := range overrides.overrides {
+		if !override.used {
+			dlog.Warnf("The servers overrides at line %d refer to [%s], which is not listed by any source", override.lineNo, name)
+		}
+	}
+}
+
+func filterRegisteredServersByProps(sourceName string, registeredServers []RegisteredServer, requiredProps ServerInformalProperties) []RegisteredServer {
+	var filteredServers []RegisteredServer
+	for _, registeredServer := range registeredServers {
+		if registeredServer.stamp.props&requiredProps != requiredProps {
+			continue
+		}
+		filteredServers = append(filteredServers, registeredServer)
+	}
+	if removed := len(registeredServers) - len(filteredServers); removed > 0 {
+		dlog.Noticef("Source [%s]: %d server(s) removed for not satisfying the required properties", sourceName, removed)
+	}
+	return filteredServers
+}
+
+func logServersProtocolsDistribution(registeredServers []RegisteredServer) {
+	counts := make(map[StampProtoType]int)
+	var protos []StampProtoType
+	for _, registeredServer := range registeredServers {
+		proto := registeredServer.stamp.proto
+		if _, ok := counts[proto]; !ok {
+			protos = append(protos, proto)
+		}
+		counts[proto]++
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+	var parts []string
+	for _, proto := range protos {
+		parts = append(parts, fmt.Sprintf("%s: %d", proto, counts[proto]))
+	}
+	dlog.Noticef("Servers loaded from sources: %d (%s)", len(registeredServers), strings.Join(parts, ", "))
+}
+
+func RenderSourcesMetrics(sources []*Source) string {
+	var buf bytes.Buffer
+	metrics := []struct {
+		name  string
+		help  string
+		kind  string
+		value func(source *Source) string
+	}{
+		{"dnscrypt_proxy_source_last_update_timestamp_seconds", "Time of the last successful update of the source", "gauge",
+			func(source *Source) string {
+				if source.lastUpdate.IsZero() {
+					return "0"
+				}
+				return strconv.FormatInt(source.lastUpdate.Unix(), 10)
+			}},
+		{"dnscrypt_proxy_source_server_count", "Number of servers parsed from the source", "gauge",
+			func(source *Source) string { return strconv.Itoa(source.serverCount) }},
+		{"dnscrypt_proxy_source_fetch_failures_total", "Number of failed attempts to load the source", "counter",
+			func(source *Source) string { return strconv.FormatUint(source.fetchFailures, 10) }},
+		{"dnscrypt_proxy_source_cache_hits_total", "Number of times the source was loaded from its cache file", "counter",
+			func(source *Source) string { return strconv.FormatUint(source.cacheHits, 10) }},
+		{"dnscrypt_proxy_source_data_age_seconds", "Age of the data the source was loaded from", "gauge",
+			func(source *Source) string {
+				age, _ := source.Staleness()
+				return strconv.FormatInt(int64(age/time.Second), 10)
+			}},
+		{"dnscrypt_proxy_source_stale", "Whether the source is served from a cache file that couldn't be refreshed", "gauge",
+			func(source *Source) string {
+				if _, stale := source.Staleness(); stale {
+					return "1"
+				}
+				return "0"
+			}},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, source := range sources {
+			fmt.Fprintf(&buf, "%s{source=%q} %s\n", metric.name, source.name, metric.value(source))
+		}
+	}
+	return buf.String()
+}
+
+func PrefetchSourceURL(ctx context.Context, urlToPrefetch *URLToPrefetch) error {
+	if _, isLocal := localSourcePath(urlToPrefetch.url); isLocal || isStdinSourceURL(urlToPrefetch.url) || (urlToPrefetch.fetchOptions != nil && urlToPrefetch.fetchOptions.offline) {
+		urlToPrefetch.when = SourcesNow().Add(urlToPrefetch.refreshDelay)
+		return nil
+	}
+	// The prefetcher works on its own copy of the source, so that it doesn't
+	// share state with the copy that was registered
+	source := *urlToPrefetch.source
+	source.warnings = nil
+	var in, sigStr string
+	var cached, sigCached, stale bool
+	var delayTillNextUpdate, sigDelayTillNextUpdate time.Duration
+	var err error
+	verifyFailed := false
+	for _, url := range source.urls() {
+		verifyFailed = false
+		in, cached, stale, delayTillNextUpdate, err = fetchWithCache(ctx, url, source.cacheFile, source.refreshDelay, &source.fetchOptions)
+		if err == nil {
+			// A new version of the source needs the signature made for it, even
+			// if the cached signature hasn't expired yet
+			sigStr, sigCached, sigDelayTillNextUpdate, err = source.fetchSignature(ctx, url, !cached)
+			if sigDelayTillNextUpdate < delayTillNextUpdate {
+				delayTillNextUpdate = sigDelayTillNextUpdate
+			}
+			if len(source.fetchOptions.inlineSig) > 0 {
+				sigCached = true
+			}
+		}
+		if err == nil && (!cached || !sigCached) {
+			if err = source.verify(in, sigStr); err != nil {
+				dlog.Noticef("Prefetched version of [%s] could not be verified: %s", url, err)
+				verifyFailed = true
+			}
+		}
+		if err == nil && !stale {
+			break
+		}
+	}
+	urlToPrefetch.changed = false
+	if err == nil && (!cached || !sigCached) {
+		sourcesCacheLock.Lock()
+		keep := false
+		if !cached && source.fetchOptions.maxShrinkPercent > 0 {
+			_, _, keep = source.keepLongerCachedList(in)
+		}
+		if keep {
+			err = fmt.Errorf("Refusing to replace source [%s] with a much shorter list", source.url)
+		} else {
+			urlToPrefetch.changed = contentChanged(source.cacheFile, in)
+			if err = source.writeCache(in, sigStr); err == nil {
+				source.storeSerial()
+				source.storeTimestamp()
+			}
+		}
+		sourcesCacheLock.Unlock()
+	}
+	now := SourcesNow()
+	if err != nil || stale {
+		urlToPrefetch.failures++
+		if backoff := prefetchBackoff(urlToPrefetch.failures, urlToPrefetch.refreshDelay); backoff > delayTillNextUpdate {
+			delayTillNextUpdate = backoff
+		}
+	} else {
+		urlToPrefetch.failures = 0
+	}
+	urlToPrefetch.when = now.Add(delayTillNextUpdate)
+	urlToPrefetch.lastError = err
+	state := SourceStateLoadedFresh
+	if err != nil && verifyFailed {
+		state = SourceStateSignatureInvalid
+	} else if err != nil {
+		state = SourceStateRefreshFailed
+	} else if stale {
+		state = SourceStateServedFromCache
+	} else {
+		urlToPrefetch.lastSuccess = now
+	}
+	urlToPrefetch.setState(state, now)
+	return err
+}
+
+// setState records the state of the URL, and notifies SourcesObserver if it
+// changed.
+func (urlToPrefetch *URLToPrefetch) setState(state SourceState, now time.Time) {
+	if state == urlToPrefetch.state {
+		return
+	}
+	urlToPrefetch.state = state
+	SourcesObserver.SourceStateChanged(urlToPrefetch.url, state, now, urlToPrefetch.lastSuccess)
 }
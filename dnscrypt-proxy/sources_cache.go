@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// SourceCache stores the downloaded sources, their signatures and the
+// metadata files next to them. Names are cache file paths.
+type SourceCache interface {
+	Read(name string) ([]byte, error)
+	Write(name string, data []byte) error
+	ModTime(name string) (time.Time, error)
+	Touch(name string) error
+	Remove(name string) error
+}
+
+// sourceCachePairWriter is implemented by caches that can replace a source
+// and its signature as a single operation.
+type sourceCachePairWriter interface {
+	WritePair(name string, data []byte, sigName string, sigData []byte) error
+}
+
+var SourcesCache SourceCache = FileSourceCache{}
+
+func writeSourceCachePair(name string, data []byte, sigName string, sigData []byte) error {
+	if pairWriter, ok := SourcesCache.(sourceCachePairWriter); ok {
+		return pairWriter.WritePair(name, data, sigName, sigData)
+	}
+	if err := SourcesCache.Write(sigName, sigData); err != nil {
+		return err
+	}
+	if err := SourcesCache.Write(name, data); err != nil {
+		SourcesCache.Remove(sigName)
+		return err
+	}
+	return nil
+}
+
+type FileSourceCache struct{}
+
+func (FileSourceCache) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (FileSourceCache) Write(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return AtomicFileWrite(name, data)
+}
+
+func (FileSourceCache) WritePair(name string, data []byte, sigName string, sigData []byte) error {
+	for _, dir := range []string{filepath.Dir(name), filepath.Dir(sigName)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return AtomicFilePairWrite(name, data, sigName, sigData)
+}
+
+func (FileSourceCache) ModTime(name string) (time.Time, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (FileSourceCache) Touch(name string) error {
+	now := SourcesNow()
+	return os.Chtimes(name, now, now)
+}
+
+func (FileSourceCache) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Removed entries are kept as tombstones, so that they are not read from the
+// read-through cache again.
+type memorySourceCacheEntry struct {
+	data    []byte
+	modTime time.Time
+	removed bool
+}
+
+// MemorySourceCache keeps everything in memory, for read-only file systems
+// and for embedders that don't want any cache files. Entries that haven't
+// been written yet can be read from another cache.
+type MemorySourceCache struct {
+	sync.Mutex
+	entries     map[string]memorySourceCacheEntry
+	readThrough SourceCache
+}
+
+func NewMemorySourceCache() *MemorySourceCache {
+	return &MemorySourceCache{entries: make(map[string]memorySourceCacheEntry)}
+}
+
+func (cache *MemorySourceCache) Read(name string) ([]byte, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[name]
+	if !ok && cache.readThrough != nil {
+		return cache.readThrough.Read(name)
+	}
+	if !ok || entry.removed {
+		return nil, &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte{}, entry.data...), nil
+}
+
+func (cache *MemorySourceCache) Write(name string, data []byte) error {
+	cache.Lock()
+	cache.entries[name] = memorySourceCacheEntry{data: append([]byte{}, data...), modTime: SourcesNow()}
+	cache.Unlock()
+	return nil
+}
+
+func (cache *MemorySourceCache) WritePair(name string, data []byte, sigName string, sigData []byte) error {
+	cache.Lock()
+	now := SourcesNow()
+	cache.entries[name] = memorySourceCacheEntry{data: append([]byte{}, data...), modTime: now}
+	cache.entries[sigName] = memorySourceCacheEntry{data: append([]byte{}, sigData...), modTime: now}
+	cache.Unlock()
+	return nil
+}
+
+func (cache *MemorySourceCache) ModTime(name string) (time.Time, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[name]
+	if !ok && cache.readThrough != nil {
+		return cache.readThrough.ModTime(name)
+	}
+	if !ok || entry.removed {
+		return time.Time{}, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return entry.modTime, nil
+}
+
+func (cache *MemorySourceCache) Touch(name string) error {
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[name]
+	if entry.removed || (!ok && cache.readThrough == nil) {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	if !ok {
+		data, err := cache.readThrough.Read(name)
+		if err != nil {
+			return err
+		}
+		entry.data = data
+	}
+	entry.modTime = SourcesNow()
+	cache.entries[name] = entry
+	return nil
+}
+
+func (cache *MemorySourceCache) Remove(name string) error {
+	cache.Lock()
+	if cache.readThrough != nil {
+		cache.entries[name] = memorySourceCacheEntry{removed: true}
+	} else {
+		delete(cache.entries, name)
+	}
+	cache.Unlock()
+	return nil
+}
+
+// canWriteCache creates dir if it doesn't exist yet, and checks that files
+// can be created in it.
+func canWriteCache(dir string) bool {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false
+	}
+	probe, err := ioutil.TempFile(dir, ".dnscrypt-proxy-probe")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
+}
+
+// useMemoryCacheIfUnwritable switches to an in-memory cache, still reading
+// the existing cache files, if any of the cache files cannot be written.
+func useMemoryCacheIfUnwritable(cacheFiles []string) {
+	if _, ok := SourcesCache.(FileSourceCache); !ok {
+		return
+	}
+	for _, cacheFile := range cacheFiles {
+		dir := filepath.Dir(cacheFile)
+		if canWriteCache(dir) {
+			continue
+		}
+		dlog.Warnf("The cache directory [%s] is not writable - sources will only be cached in memory", dir)
+		SourcesCache = &MemorySourceCache{entries: make(map[string]memorySourceCacheEntry), readThrough: FileSourceCache{}}
+		return
+	}
+}
@@ -0,0 +1,1668 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testSigner struct {
+	keyID     [8]byte
+	secretKey ed25519.PrivateKey
+	publicKey ed25519.PublicKey
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	publicKey, secretKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &testSigner{secretKey: secretKey, publicKey: publicKey}
+	copy(signer.keyID[:], "testkey0")
+	return signer
+}
+
+func (signer *testSigner) publicKeyStr() string {
+	bin := append([]byte("Ed"), signer.keyID[:]...)
+	return base64.StdEncoding.EncodeToString(append(bin, signer.publicKey...))
+}
+
+func (signer *testSigner) sign(in string, trustedComment string) string {
+	return signer.signWithAlgorithm("Ed", []byte(in), trustedComment)
+}
+
+func (signer *testSigner) signPrehashed(in string, trustedComment string) string {
+	hash := blake2b.Sum512([]byte(in))
+	return signer.signWithAlgorithm("ED", hash[:], trustedComment)
+}
+
+func (signer *testSigner) signWithAlgorithm(algorithm string, bin []byte, trustedComment string) string {
+	sig := ed25519.Sign(signer.secretKey, bin)
+	bin = append(append([]byte(algorithm), signer.keyID[:]...), sig...)
+	globalSig := ed25519.Sign(signer.secretKey, append(sig, []byte(trustedComment)...))
+	return "untrusted comment: test\n" + base64.StdEncoding.EncodeToString(bin) + "\ntrusted comment: " + trustedComment + "\n" + base64.StdEncoding.EncodeToString(globalSig) + "\n"
+}
+
+func testDNSCryptStamp(t *testing.T, addr string, providerName string) ServerStamp {
+	stamp, err := NewDNSCryptServerStampFromLegacy(addr, strings.Repeat("ab", 32), providerName, ServerInformalPropertyDNSSEC|ServerInformalPropertyNoLog|ServerInformalPropertyNoFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stamp
+}
+
+func testStampString(t *testing.T, addr string, providerName string) string {
+	stamp := testDNSCryptStamp(t, addr, providerName)
+	return stamp.String()
+}
+
+func testV2Source(t *testing.T, names ...string) string {
+	var in string
+	for i, name := range names {
+		stamp := testStampString(t, "192.0.2."+string('1'+byte(i)), "2.dnscrypt-cert."+name)
+		in += "## " + name + "\n\n" + name + " server\n\n" + stamp + "\n\n"
+	}
+	return in
+}
+
+const testV1Header = "Name,Full name,Description,Location,Coordinates,URL,Version,DNSSEC validation,No logs,Namecoin,Resolver address,Provider name,Provider public key,Provider public key TXT record\n"
+
+func testV1Line(name string, addr string) string {
+	return name + "," + name + ",Test server,Earth,,https://example.com,1,yes,yes,no," + addr + ",2.dnscrypt-cert." + name + "," + strings.Repeat("ABCD:", 15) + "ABCD,\n"
+}
+
+func testTempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "sources-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSourceServer serves files whose content can be changed while a test is
+// running. Paths without content return a 404.
+type testSourceServer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	files       map[string]string
+	requests    map[string]int
+	unavailable bool
+}
+
+func newTestSourceServer() *testSourceServer {
+	server := &testSourceServer{files: make(map[string]string), requests: make(map[string]int)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		content, ok := server.files[r.URL.Path]
+		server.requests[r.URL.Path]++
+		unavailable := server.unavailable
+		server.mu.Unlock()
+		if unavailable {
+			w.Header().Set("Retry-After", "7200")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(content))
+	}))
+	return server
+}
+
+func (server *testSourceServer) set(path string, content string) {
+	server.mu.Lock()
+	server.files[path] = content
+	server.mu.Unlock()
+}
+
+func (server *testSourceServer) remove(path string) {
+	server.mu.Lock()
+	delete(server.files, path)
+	server.mu.Unlock()
+}
+
+func (server *testSourceServer) requestCount(path string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.requests[path]
+}
+
+// setTestNow moves the clock of the sources forward by offset.
+func setTestNow(offset time.Duration) func() {
+	SourcesNow = func() time.Time { return time.Now().Add(offset) }
+	return func() { SourcesNow = time.Now }
+}
+
+func setTestSourcesCache(cache SourceCache) func() {
+	savedCache := SourcesCache
+	SourcesCache = cache
+	return func() { SourcesCache = savedCache }
+}
+
+func registeredServerNames(registeredServers []RegisteredServer) []string {
+	var names []string
+	for _, registeredServer := range registeredServers {
+		names = append(names, registeredServer.name)
+	}
+	return names
+}
+
+func TestStampTransformerFromFetchOptions(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	sourceFile := filepath.Join(dir, "servers.md")
+	writeTestFile(t, sourceFile, testV2Source(t, "kept", "dropped"))
+	transformer := func(name string, stamp ServerStamp) (ServerStamp, bool) {
+		stamp.providerName = "2.dnscrypt-cert.transformed"
+		return stamp, name != "dropped"
+	}
+	fetchOptions := SourceFetchOptions{insecureNoSignature: true, stampTransformer: transformer}
+	source, _, err := NewSource(context.Background(), sourceFile, nil, "", filepath.Join(dir, "cache.md"), "v2", time.Hour, fetchOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registeredServers, err := source.Parse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registeredServers) != 1 || registeredServers[0].name != "kept" {
+		t.Fatalf("Unexpected servers: %v", registeredServerNames(registeredServers))
+	}
+	if providerName := registeredServers[0].stamp.providerName; providerName != "2.dnscrypt-cert.transformed" {
+		t.Fatalf("Stamp not transformed: [%s]", providerName)
+	}
+}
+
+func TestSourceSettingsFromFetchOptions(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	first := "## nostamp\n\n" + testV2Source(t, "first", "second", "third", "fourth")
+	server.set("/list.md", first)
+	server.set("/list.md.minisig", signer.sign(first, "timestamp:100"))
+	fetchOptions := SourceFetchOptions{name: "test-source", lenient: true, addressFamily: SourceAddressFamilyIPv4, maxShrinkPercent: 50}
+	source, urlsToPrefetch := loadTestSource(t, server.URL+"/list.md", signer, filepath.Join(dir, "cache.md"), fetchOptions)
+	for _, s := range []*Source{&source, urlsToPrefetch[0].source} {
+		if s.name != "test-source" || !s.lenient || s.addressFamily != SourceAddressFamilyIPv4 {
+			t.Fatalf("The settings of the source were not applied: %+v", s)
+		}
+	}
+
+	// The cached list is parsed in lenient mode by the prefetcher as well, so
+	// going from four servers to one is a shrink
+	second := testV2Source(t, "first")
+	server.set("/list.md", second)
+	server.set("/list.md.minisig", signer.sign(second, "timestamp:200"))
+	defer setTestNow(2 * time.Hour)()
+	if err := PrefetchSourceURL(context.Background(), &urlsToPrefetch[0]); err == nil {
+		t.Fatal("The cached list was replaced with a much shorter one")
+	}
+}
+
+func TestRollbackUsesVerifiedTimestamp(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	cacheFile := filepath.Join(dir, "cache.md")
+	first := testV2Source(t, "first")
+	server.set("/list.md", first)
+	server.set("/list.md.minisig", signer.sign(first, "timestamp:200"))
+	if _, _, err := NewSource(context.Background(), server.URL+"/list.md", nil, signer.publicKeyStr(), cacheFile, "v2", time.Hour, SourceFetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ts, err := ioutil.ReadFile(cacheFile + SourceTimestampSuffix); err != nil || string(ts) != "200" {
+		t.Fatalf("Unexpected stored timestamp: [%s] (%v)", ts, err)
+	}
+
+	// A signature written to the cache without being verified must not be
+	// used to detect rollbacks
+	writeTestFile(t, cacheFile+".minisig", signer.sign("something else", "timestamp:999"))
+	second := testV2Source(t, "second")
+	server.set("/list.md", second)
+	server.set("/list.md.minisig", signer.sign(second, "timestamp:300"))
+	defer setTestNow(2 * time.Hour)()
+	source, _, err := NewSource(context.Background(), server.URL+"/list.md", nil, signer.publicKeyStr(), cacheFile, "v2", time.Hour, SourceFetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.in != second {
+		t.Fatal("The newer version of the source was not loaded")
+	}
+}
+
+func TestRollbackFallsBackToCache(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	cacheFile := filepath.Join(dir, "cache.md")
+	newer := testV2Source(t, "newer")
+	server.set("/list.md", newer)
+	server.set("/list.md.minisig", signer.sign(newer, "timestamp:200"))
+	if _, _, err := NewSource(context.Background(), server.URL+"/list.md", nil, signer.publicKeyStr(), cacheFile, "v2", time.Hour, SourceFetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	older := testV2Source(t, "older")
+	server.set("/list.md", older)
+	server.set("/list.md.minisig", signer.sign(older, "timestamp:100"))
+	defer setTestNow(2 * time.Hour)()
+	source, _, err := NewSource(context.Background(), server.URL+"/list.md", nil, signer.publicKeyStr(), cacheFile, "v2", time.Hour, SourceFetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.in != newer {
+		t.Fatal("The source was rolled back")
+	}
+	if _, stale := source.Staleness(); !stale {
+		t.Fatal("The cached version should be reported as stale")
+	}
+}
+
+func TestRollbackToLastKnownGoodRestoresSidecars(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	cacheFile := filepath.Join(dir, "cache.md")
+	good := testV2Source(t, "good")
+	server.set("/list.md", good)
+	server.set("/list.md.minisig", signer.sign(good, "timestamp:100\tserial:1"))
+	source, _ := loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	if err := source.PromoteLastKnownGood(); err != nil {
+		t.Fatal(err)
+	}
+
+	broken := "## broken\n\n" + good
+	server.set("/list.md", broken)
+	server.set("/list.md.minisig", signer.sign(broken, "timestamp:200\tserial:2"))
+	restoreNow := setTestNow(2 * time.Hour)
+	source, _ = loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	restoreNow()
+	if _, err := source.Parse(""); err == nil {
+		t.Fatal("The broken version of the source was parsed")
+	}
+	if err := source.RollbackToLastKnownGood(); err != nil {
+		t.Fatal(err)
+	}
+	for suffix, expected := range map[string]string{SourceTimestampSuffix: "100", ".serial": "1"} {
+		if content, err := ioutil.ReadFile(cacheFile + suffix); err != nil || string(content) != expected {
+			t.Errorf("Unexpected content for [%s] after the rollback: [%s] (%v)", suffix, content, err)
+		}
+	}
+
+	// The restored cache is still fresh, and must be usable on the next start
+	source, _ = loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	if source.in != good || checkCachedPair(t, &source) != good {
+		t.Fatal("The restored version of the source was not used")
+	}
+}
+
+func TestV1SourceWithShippedConfig(t *testing.T) {
+	config := newConfig()
+	if _, err := toml.DecodeFile("dnscrypt-proxy.toml", &config); err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewSourceFromString("v1", testV1Header+testV1Line("first", "192.0.2.1")+testV1Line("second", "192.0.2.2:5353"), SourceFormatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registeredServers, err := source.Parse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requiredProps := source.requiredProperties(config.requiredServerProperties())
+	var names []string
+	for _, registeredServer := range registeredServers {
+		if registeredServer.stamp.props&requiredProps == requiredProps {
+			names = append(names, registeredServer.name)
+		}
+	}
+	if len(names) != 2 {
+		t.Fatalf("Servers from a v1 list were dropped with the shipped configuration: %v", names)
+	}
+}
+
+func TestV1ServerAddresses(t *testing.T) {
+	tests := []struct {
+		addr      string
+		serverStr string
+	}{
+		{"192.0.2.1", "192.0.2.1:443"},
+		{"192.0.2.1:5353", "192.0.2.1:5353"},
+		{"192.0.2.1:65535", "192.0.2.1:65535"},
+		{"192.0.2.1:99999", ""},
+		{"192.0.2.1:65536", ""},
+		{"192.0.2.1:0", ""},
+		{"192.0.2.1:", ""},
+		{"192.0.2.1:dns", ""},
+		{"2001:db8::1", "[2001:db8::1]:443"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"[2001:db8::1]:5353", "[2001:db8::1]:5353"},
+		{"[2001:db8::1]:99999", ""},
+		{"[192.0.2.1]:443", ""},
+		{"resolver.example:443", "resolver.example:443"},
+		{"resolver_example!:443", ""},
+	}
+	for _, test := range tests {
+		in := testV1Header + testV1Line("first", "192.0.2.2") + testV1Line("second", test.addr)
+		for _, lenient := range []bool{false, true} {
+			source, err := NewSourceFromString("v1", in, SourceFormatV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source.lenient = lenient
+			registeredServers, err := source.Parse("")
+			if len(test.serverStr) == 0 && !lenient {
+				parseErr, ok := err.(*SourceParseError)
+				if !ok || parseErr.line != 3 || parseErr.field != 11 {
+					t.Errorf("[%s]: expected an error for line 3, got %v", test.addr, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("[%s]: unexpected error: %v", test.addr, err)
+				continue
+			}
+			if len(test.serverStr) == 0 {
+				if len(registeredServers) != 1 || registeredServers[0].name != "first" || len(source.warnings) == 0 {
+					t.Errorf("[%s]: the entry was not skipped: %v", test.addr, registeredServerNames(registeredServers))
+				}
+				continue
+			}
+			if len(registeredServers) != 2 || registeredServers[1].stamp.serverAddrStr != test.serverStr {
+				t.Errorf("[%s]: unexpected servers: %v", test.addr, registeredServers)
+			}
+		}
+	}
+}
+
+func TestParseV1MalformedCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		line int
+	}{
+		{"unterminated quote", testV1Header + testV1Line("first", "192.0.2.1") + "\"second,second\n", 3},
+		{"bare quote", testV1Header + "fi\"rst" + testV1Line("", "192.0.2.1")[1:], 2},
+		{"missing fields", testV1Header + testV1Line("first", "192.0.2.1") + "second,second,Test server\n", 3},
+		{"short header", "Name,Full name\n" + testV1Line("first", "192.0.2.1"), 2},
+	}
+	for _, test := range tests {
+		source, err := NewSourceFromString("v1", test.in, SourceFormatV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = source.Parse("")
+		parseErr, ok := err.(*SourceParseError)
+		if !ok {
+			t.Errorf("%s: expected a parse error, got %v", test.name, err)
+			continue
+		}
+		if parseErr.line != test.line {
+			t.Errorf("%s: error reported at line %d instead of %d: %s", test.name, parseErr.line, test.line, parseErr)
+		}
+	}
+}
+
+func TestDuplicateServerNames(t *testing.T) {
+	first, second := testStampString(t, "192.0.2.1", "2.dnscrypt-cert.first"), testStampString(t, "192.0.2.2", "2.dnscrypt-cert.second")
+	tests := []struct {
+		name   string
+		format SourceFormat
+		in     string
+	}{
+		{"v1", SourceFormatV1, testV1Header + testV1Line("dup", "192.0.2.1") + testV1Line("other", "192.0.2.3") + testV1Line("dup", "192.0.2.2")},
+		{"v2", SourceFormatV2, "## dup\n" + first + "\n## other\n" + testStampString(t, "192.0.2.3", "2.dnscrypt-cert.other") + "\n## dup\n" + second + "\n"},
+	}
+	for _, test := range tests {
+		source, err := NewSourceFromString(test.name, test.in, test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registeredServers, err := source.Parse("")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if names := registeredServerNames(registeredServers); len(names) != 2 || names[0] != "dup" || names[1] != "other" {
+			t.Fatalf("%s: unexpected servers: %v", test.name, names)
+		}
+		if addr := registeredServers[0].stamp.serverAddrStr; addr != "192.0.2.1:443" {
+			t.Errorf("%s: the first occurrence was not kept: [%s]", test.name, addr)
+		}
+	}
+}
+
+func loadTestSource(t *testing.T, url string, signer *testSigner, cacheFile string, fetchOptions SourceFetchOptions) (Source, []URLToPrefetch) {
+	source, urlsToPrefetch, err := NewSource(context.Background(), url, nil, signer.publicKeyStr(), cacheFile, "v2", time.Hour, fetchOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source, urlsToPrefetch
+}
+
+// checkCachedPair fails if the cached source isn't signed by the cached
+// signature, and returns its content otherwise.
+func checkCachedPair(t *testing.T, source *Source) string {
+	in, err := ioutil.ReadFile(source.cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigStr, err := ioutil.ReadFile(source.sigCacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.verifySignature(string(in), string(sigStr)); err != nil {
+		t.Fatalf("The cached source and signature don't match: %v", err)
+	}
+	return string(in)
+}
+
+func TestPrefetchWritesCachePair(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	first := testV2Source(t, "first")
+	server.set("/list.md", first)
+	server.set("/list.md.minisig", signer.sign(first, "timestamp:100"))
+	source, urlsToPrefetch := loadTestSource(t, server.URL+"/list.md", signer, filepath.Join(dir, "cache.md"), SourceFetchOptions{})
+	if len(urlsToPrefetch) != 1 {
+		t.Fatalf("Expected the source and its signature to be prefetched together, got %d entries", len(urlsToPrefetch))
+	}
+
+	second := testV2Source(t, "second")
+	server.set("/list.md", second)
+	server.set("/list.md.minisig", signer.sign(second, "timestamp:200"))
+	defer setTestNow(2 * time.Hour)()
+	if err := PrefetchSourceURL(context.Background(), &urlsToPrefetch[0]); err != nil {
+		t.Fatal(err)
+	}
+	if in := checkCachedPair(t, &source); in != second {
+		t.Fatal("The prefetched version was not cached")
+	}
+}
+
+func TestHalfWrittenCachePairRecovery(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	cacheFile := filepath.Join(dir, "cache.md")
+	first := testV2Source(t, "first")
+	server.set("/list.md", first)
+	server.set("/list.md.minisig", signer.sign(first, "timestamp:100"))
+	loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+
+	// The new content was written, but not its signature
+	writeTestFile(t, cacheFile, testV2Source(t, "second"))
+	source, _ := loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	if source.in != first {
+		t.Fatal("The source was not downloaded again")
+	}
+	if in := checkCachedPair(t, &source); in != first {
+		t.Fatal("The cache was not repaired")
+	}
+}
+
+func TestV2BlockWithoutStamp(t *testing.T) {
+	valid := testV2Source(t, "valid")
+	tests := []struct {
+		name    string
+		in      string
+		lenient bool
+		servers int
+		fails   bool
+	}{
+		{"name only, strict", "## nostamp\n" + valid, false, 0, true},
+		{"name only, lenient", "## nostamp\n" + valid, true, 1, false},
+		{"name only at the end, lenient", valid + "## nostamp", true, 1, false},
+		{"description only, lenient", "## nostamp\nNo stamp here\n\n" + valid, true, 1, false},
+		{"description only, strict", "## nostamp\nNo stamp here\n\n" + valid, false, 0, true},
+	}
+	for _, test := range tests {
+		source, err := NewSourceFromString("v2", test.in, SourceFormatV2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.lenient = test.lenient
+		registeredServers, err := source.Parse("")
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !test.fails && len(registeredServers) != test.servers {
+			t.Errorf("%s: expected %d servers, got %v", test.name, test.servers, registeredServerNames(registeredServers))
+		}
+	}
+}
+
+func TestV2BlockWithoutName(t *testing.T) {
+	valid := testV2Source(t, "first", "second")
+	tests := []struct {
+		name    string
+		in      string
+		lenient bool
+		block   int
+		servers int
+	}{
+		{"trailing separator, strict", valid + "## ", false, 3, 0},
+		{"trailing separator with a newline, strict", valid + "## \n", false, 3, 0},
+		{"trailing separator, lenient", valid + "## ", true, 0, 2},
+		{"trailing separator with CRLF, lenient", valid + "## \r\n", true, 0, 2},
+		{"separator between entries, strict", testV2Source(t, "first") + "## \n\n" + testV2Source(t, "second"), false, 2, 0},
+		{"separator between entries, lenient", testV2Source(t, "first") + "## \n\n" + testV2Source(t, "second"), true, 0, 2},
+	}
+	for _, test := range tests {
+		source, err := NewSourceFromString("v2", test.in, SourceFormatV2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.lenient = test.lenient
+		registeredServers, err := source.Parse("")
+		if test.block > 0 {
+			parseErr, ok := err.(*SourceParseError)
+			if !ok || parseErr.block != test.block {
+				t.Errorf("%s: expected an error for block %d, got %v", test.name, test.block, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(registeredServers) != test.servers {
+			t.Errorf("%s: expected %d servers, got %v", test.name, test.servers, registeredServerNames(registeredServers))
+		}
+		if len(source.warnings) != 1 || !strings.Contains(source.warnings[0], "Missing server name") {
+			t.Errorf("%s: the skipped block was not reported: %v", test.name, source.warnings)
+		}
+	}
+}
+
+func TestSourceStaleness(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	cacheFile := filepath.Join(dir, "cache.md")
+	in := testV2Source(t, "server")
+	server.set("/list.md", in)
+	server.set("/list.md.minisig", signer.sign(in, "timestamp:100"))
+	source, _ := loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	if age, stale := source.Staleness(); stale || age > time.Minute {
+		t.Fatalf("Unexpected staleness of a fresh source: %v, %v", age, stale)
+	}
+
+	server.remove("/list.md")
+	server.remove("/list.md.minisig")
+	defer setTestNow(2 * time.Hour)()
+	source, _ = loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	if age, stale := source.Staleness(); !stale || age < 2*time.Hour-time.Minute || age > 2*time.Hour+time.Minute {
+		t.Fatalf("Unexpected staleness of a source loaded from an expired cache: %v, %v", age, stale)
+	}
+}
+
+func TestValidateSourceFileFromStdin(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	stdinFile := filepath.Join(dir, "stdin")
+	writeTestFile(t, stdinFile, testV2Source(t, "first", "second"))
+	stdin, err := os.Open(stdinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	savedStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = savedStdin }()
+	registeredServers, _, err := ValidateSourceFile("-", "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registeredServers) != 2 {
+		t.Fatalf("Unexpected servers: %v", registeredServerNames(registeredServers))
+	}
+}
+
+func TestV2SourceWithBOMAndCRLF(t *testing.T) {
+	unix := testV2Source(t, "first", "second")
+	windows := strings.Replace(unix, "\n", "\r\n", -1)
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"unix", unix},
+		{"bom", "\ufeff" + unix},
+		{"crlf", windows},
+		{"bom and crlf", "\ufeff" + windows},
+		{"bom, crlf and header", "\ufeffformat_version: 2\r\n\r\n" + windows},
+	}
+	for _, test := range tests {
+		format, err := detectSourceFormat(test.in)
+		if err != nil || format != SourceFormatV2 {
+			t.Errorf("%s: detected as format v%d (%v)", test.name, format+1, err)
+			continue
+		}
+		source, err := NewSourceFromString(test.name, test.in, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registeredServers, err := source.Parse("")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if names := registeredServerNames(registeredServers); len(names) != 2 || names[0] != "first" || names[1] != "second" {
+			t.Errorf("%s: unexpected servers: %q", test.name, names)
+			continue
+		}
+		if description := registeredServers[0].description; description != "first server" {
+			t.Errorf("%s: unexpected description: %q", test.name, description)
+		}
+	}
+}
+
+func TestNormalizeServerAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+		fails    bool
+	}{
+		{"192.0.2.1", "192.0.2.1", false},
+		{"192.0.2.1:443", "192.0.2.1:443", false},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443", false},
+		{"dns.example.com:443", "dns.example.com:443", false},
+		{"bücher.example", "xn--bcher-kva.example", false},
+		{"Bücher.example:5353", "xn--bcher-kva.example:5353", false},
+		{"b%C3%BCcher.example:443", "xn--bcher-kva.example:443", false},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", false},
+		{"BÜCHER.example", "xn--bcher-kva.example", false},
+		{"bu\u0308cher.example:443", "xn--bcher-kva.example:443", false},
+		{"bücher\u3002example", "xn--bcher-kva.example", false},
+		{"bü cher.example", "", true},
+		{"bad%zz.example", "", true},
+	}
+	for _, test := range tests {
+		addr, err := normalizeServerAddr(test.addr)
+		if (err != nil) != test.fails {
+			t.Errorf("[%s]: unexpected error: %v", test.addr, err)
+			continue
+		}
+		if !test.fails && addr != test.expected {
+			t.Errorf("[%s]: normalized as [%s] instead of [%s]", test.addr, addr, test.expected)
+		}
+	}
+}
+
+func TestV1SourceWithIDNAddress(t *testing.T) {
+	source, err := NewSourceFromString("v1", testV1Header+testV1Line("idn", "bücher.example:443"), SourceFormatV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registeredServers, err := source.Parse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registeredServers) != 1 || registeredServers[0].stamp.serverAddrStr != "xn--bcher-kva.example:443" {
+		t.Fatalf("Unexpected servers: %v", registeredServers)
+	}
+}
+
+func TestMemorySourceCache(t *testing.T) {
+	cache := NewMemorySourceCache()
+	if _, err := cache.Read("missing"); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected error for a missing entry: %v", err)
+	}
+	if err := cache.Touch("missing"); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected error when touching a missing entry: %v", err)
+	}
+	data := []byte("content")
+	if err := cache.Write("file", data); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'X'
+	if bin, err := cache.Read("file"); err != nil || string(bin) != "content" {
+		t.Fatalf("Unexpected content: [%s] (%v)", bin, err)
+	}
+	modTime, err := cache.ModTime("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreNow := setTestNow(time.Hour)
+	err = cache.Touch("file")
+	restoreNow()
+	if touched, _ := cache.ModTime("file"); err != nil || !touched.After(modTime) {
+		t.Fatalf("The entry was not touched: %v (%v)", touched, err)
+	}
+	if err := cache.WritePair("list", []byte("list"), "list.minisig", []byte("sig")); err != nil {
+		t.Fatal(err)
+	}
+	listTime, _ := cache.ModTime("list")
+	sigTime, _ := cache.ModTime("list.minisig")
+	if !listTime.Equal(sigTime) {
+		t.Fatal("Both entries of a pair should have the same modification time")
+	}
+	cache.Remove("file")
+	if _, err := cache.Read("file"); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected error for a removed entry: %v", err)
+	}
+}
+
+func TestSourceWithMemoryCache(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	in := testV2Source(t, "server")
+	server.set("/list.md", in)
+	server.set("/list.md.minisig", signer.sign(in, "timestamp:100"))
+	cache := NewMemorySourceCache()
+	defer setTestSourcesCache(cache)()
+	cacheFile := filepath.Join(dir, "cache.md")
+	loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files were written with a memory cache", len(files))
+	}
+	if bin, err := cache.Read(cacheFile); err != nil || string(bin) != in {
+		t.Fatalf("The source was not cached in memory: %v", err)
+	}
+
+	// The second load must be served from the memory cache
+	loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+	if count := server.requestCount("/list.md"); count != 1 {
+		t.Fatalf("The source was downloaded %d times", count)
+	}
+}
+
+func TestPrefetchKeepsCacheOnRejectedUpdate(t *testing.T) {
+	first := testV2Source(t, "a", "b", "c", "d")
+	tests := []struct {
+		name         string
+		fetchOptions SourceFetchOptions
+		update       func(server *testSourceServer, signer *testSigner)
+	}{
+		{"invalid signature", SourceFetchOptions{}, func(server *testSourceServer, signer *testSigner) {
+			server.set("/list.md", testV2Source(t, "a", "b", "c", "d", "e"))
+			server.set("/list.md.minisig", signer.sign("something else", "timestamp:200"))
+		}},
+		{"rollback", SourceFetchOptions{}, func(server *testSourceServer, signer *testSigner) {
+			older := testV2Source(t, "a", "b", "c")
+			server.set("/list.md", older)
+			server.set("/list.md.minisig", signer.sign(older, "timestamp:50"))
+		}},
+		{"shrink", SourceFetchOptions{maxShrinkPercent: 50}, func(server *testSourceServer, signer *testSigner) {
+			shorter := testV2Source(t, "a")
+			server.set("/list.md", shorter)
+			server.set("/list.md.minisig", signer.sign(shorter, "timestamp:200"))
+		}},
+	}
+	for _, test := range tests {
+		func() {
+			dir, cleanup := testTempDir(t)
+			defer cleanup()
+			server := newTestSourceServer()
+			defer server.Close()
+			signer := newTestSigner(t)
+			server.set("/list.md", first)
+			server.set("/list.md.minisig", signer.sign(first, "timestamp:100"))
+			source, urlsToPrefetch := loadTestSource(t, server.URL+"/list.md", signer, filepath.Join(dir, "cache.md"), test.fetchOptions)
+
+			test.update(server, signer)
+			defer setTestNow(2 * time.Hour)()
+			if err := PrefetchSourceURL(context.Background(), &urlsToPrefetch[0]); err == nil {
+				t.Errorf("%s: the update was not rejected", test.name)
+			}
+			if in := checkCachedPair(t, &source); in != first {
+				t.Errorf("%s: the cache was replaced", test.name)
+			}
+		}()
+	}
+}
+
+func TestStaleCacheExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		expiry time.Duration
+		age    time.Duration
+		fails  bool
+	}{
+		{"no expiry", 0, 30 * 24 * time.Hour, false},
+		{"before the expiry", 24 * time.Hour, 12 * time.Hour, false},
+		{"after the expiry", 24 * time.Hour, 36 * time.Hour, true},
+	}
+	for _, test := range tests {
+		func() {
+			dir, cleanup := testTempDir(t)
+			defer cleanup()
+			server := newTestSourceServer()
+			defer server.Close()
+			signer := newTestSigner(t)
+			cacheFile := filepath.Join(dir, "cache.md")
+			in := testV2Source(t, "server")
+			server.set("/list.md", in)
+			server.set("/list.md.minisig", signer.sign(in, "timestamp:100"))
+			fetchOptions := SourceFetchOptions{staleCacheExpiry: test.expiry}
+			loadTestSource(t, server.URL+"/list.md", signer, cacheFile, fetchOptions)
+
+			server.remove("/list.md")
+			server.remove("/list.md.minisig")
+			defer setTestNow(test.age)()
+			source, _, err := NewSource(context.Background(), server.URL+"/list.md", nil, signer.publicKeyStr(), cacheFile, "v2", time.Hour, fetchOptions)
+			if (err != nil) != test.fails {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			if err == nil && source.in != in {
+				t.Errorf("%s: the stale cache was not used", test.name)
+			}
+		}()
+	}
+}
+
+func TestCanWriteCacheCreatesDirectory(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	cacheDir := filepath.Join(dir, "not", "created", "yet")
+	if !canWriteCache(cacheDir) {
+		t.Fatal("A cache directory that doesn't exist yet was reported as unwritable")
+	}
+	if fi, err := os.Stat(cacheDir); err != nil || !fi.IsDir() {
+		t.Fatalf("The cache directory was not created: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(cacheDir); len(files) != 0 {
+		t.Fatal("The probe file was not removed")
+	}
+	blocker := filepath.Join(dir, "file")
+	writeTestFile(t, blocker, "")
+	if canWriteCache(filepath.Join(blocker, "cache")) {
+		t.Fatal("A cache directory below a file was reported as writable")
+	}
+}
+
+func TestMemorySourceCacheRemoveReadThrough(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	cacheFile := filepath.Join(dir, "cache.md")
+	writeTestFile(t, cacheFile, "on disk")
+	cache := &MemorySourceCache{entries: make(map[string]memorySourceCacheEntry), readThrough: FileSourceCache{}}
+	if bin, err := cache.Read(cacheFile); err != nil || string(bin) != "on disk" {
+		t.Fatalf("The file was not read through: [%s] (%v)", bin, err)
+	}
+	cache.Remove(cacheFile)
+	if _, err := cache.Read(cacheFile); !os.IsNotExist(err) {
+		t.Fatalf("A removed entry was read through: %v", err)
+	}
+	if _, err := cache.ModTime(cacheFile); !os.IsNotExist(err) {
+		t.Fatalf("A removed entry has a modification time: %v", err)
+	}
+	if err := cache.Touch(cacheFile); !os.IsNotExist(err) {
+		t.Fatalf("A removed entry was touched: %v", err)
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Fatal("The file of the read-through cache was removed")
+	}
+	cache.Write(cacheFile, []byte("in memory"))
+	if bin, err := cache.Read(cacheFile); err != nil || string(bin) != "in memory" {
+		t.Fatalf("An entry written after being removed can't be read: [%s] (%v)", bin, err)
+	}
+}
+
+func TestParseStreamMatchesParse(t *testing.T) {
+	valid := testV2Source(t, "first", "second")
+	ipv6 := "## ipv6\n" + testStampString(t, "[2001:db8::1]:443", "2.dnscrypt-cert.ipv6") + "\n"
+	private := "## private\n" + testStampString(t, "10.0.0.1", "2.dnscrypt-cert.private") + "\n"
+	tests := []struct {
+		name          string
+		in            string
+		lenient       bool
+		addressFamily string
+	}{
+		{"plain", valid, false, ""},
+		{"leading text", "# Resolvers\n\nformat_version: 2\n\n" + valid, false, ""},
+		{"no blocks", "# Resolvers\n", false, ""},
+		{"double hash inside a description", "## hash\nUses ## in its description\n" + testStampString(t, "192.0.2.9", "2.dnscrypt-cert.hash") + "\n" + valid, false, ""},
+		{"missing stamp, lenient", "## nostamp\n" + valid, true, ""},
+		{"missing stamp, strict", "## nostamp\n" + valid, false, ""},
+		{"private address, lenient", private + valid, true, ""},
+		{"ipv6 only", valid + ipv6, false, SourceAddressFamilyIPv6},
+		{"ipv4 only", valid + ipv6, false, SourceAddressFamilyIPv4},
+	}
+	for _, test := range tests {
+		source, err := NewSourceFromString("v2", test.in, SourceFormatV2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.lenient, source.addressFamily = test.lenient, test.addressFamily
+		registeredServers, parseErr := source.Parse("")
+		var streamedServers []RegisteredServer
+		streamErr := source.ParseStream(strings.NewReader(test.in), "", func(registeredServer RegisteredServer) error {
+			streamedServers = append(streamedServers, registeredServer)
+			return nil
+		})
+		if (parseErr != nil) != (streamErr != nil) {
+			t.Errorf("%s: Parse returned [%v], ParseStream returned [%v]", test.name, parseErr, streamErr)
+			continue
+		}
+		if parseErr != nil {
+			continue
+		}
+		if !sameRegisteredServers(registeredServers, streamedServers) {
+			t.Errorf("%s: Parse returned %v, ParseStream returned %v", test.name, registeredServerNames(registeredServers), registeredServerNames(streamedServers))
+		}
+	}
+}
+
+func TestAddressFamilyOfPrimaryStamp(t *testing.T) {
+	ipv4Stamp := testStampString(t, "192.0.2.1", "2.dnscrypt-cert.example")
+	ipv6Stamp := testStampString(t, "[2001:db8::1]:443", "2.dnscrypt-cert.example")
+	in := "## ipv4\n" + ipv4Stamp + "\n" + ipv6Stamp + "\n\n" +
+		"## ipv6\n" + ipv6Stamp + "\n" + ipv4Stamp + "\n\n"
+	tests := []struct {
+		addressFamily string
+		servers       []string
+	}{
+		{SourceAddressFamilyBoth, []string{"ipv4", "ipv6"}},
+		{SourceAddressFamilyIPv4, []string{"ipv4"}},
+		{SourceAddressFamilyIPv6, []string{"ipv6"}},
+	}
+	for _, test := range tests {
+		source, err := NewSourceFromString("v2", in, SourceFormatV2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.addressFamily = test.addressFamily
+		registeredServers, err := source.Parse("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var streamedServers []RegisteredServer
+		if err := source.ParseStream(strings.NewReader(in), "", func(registeredServer RegisteredServer) error {
+			streamedServers = append(streamedServers, registeredServer)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, servers := range [][]RegisteredServer{registeredServers, streamedServers} {
+			if names := registeredServerNames(servers); strings.Join(names, ",") != strings.Join(test.servers, ",") {
+				t.Errorf("%s: expected %v, got %v", test.addressFamily, test.servers, names)
+			}
+		}
+	}
+}
+
+func TestAddressFamilyWithBootstrapResolver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(query)
+		question := query.Question[0]
+		switch {
+		case question.Name == "v4.example." && question.Qtype == dns.TypeA:
+			response.Answer = append(response.Answer, &dns.A{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+		case question.Name == "v6.example." && question.Qtype == dns.TypeAAAA:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		w.WriteMsg(response)
+	})}
+	started := make(chan struct{})
+	resolver.NotifyStartedFunc = func() { close(started) }
+	go resolver.ActivateAndServe()
+	<-started
+	defer resolver.Shutdown()
+
+	var in string
+	for _, name := range []string{"v4", "v6"} {
+		stamp := ServerStamp{proto: StampProtoTypeDoH, providerName: name + ".example", path: "/dns-query"}
+		in += "## " + name + "\n" + stamp.String() + "\n\n"
+	}
+	source, err := NewSourceFromString("v2", in, SourceFormatV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.addressFamily, source.resolveHosts = SourceAddressFamilyIPv4, true
+	source.fetchOptions.bootstrapResolver = pc.LocalAddr().String()
+	registeredServers, err := source.Parse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := registeredServerNames(registeredServers); len(names) != 1 || names[0] != "v4" {
+		t.Fatalf("Expected only the server resolving to an IPv4 address, got %v", names)
+	}
+}
+
+func benchmarkV2Source(b *testing.B, count int) string {
+	var in bytes.Buffer
+	for i := 0; i < count; i++ {
+		stamp, err := NewDNSCryptServerStampFromLegacy(fmt.Sprintf("192.0.%d.%d", i/250, 1+i%250), strings.Repeat("ab", 32), fmt.Sprintf("2.dnscrypt-cert.server-%d", i), ServerInformalPropertyNoLog)
+		if err != nil {
+			b.Fatal(err)
+		}
+		fmt.Fprintf(&in, "## server-%d\n\nServer number %d, with a description\nspanning a couple of lines.\n\n%s\n\n", i, i, stamp.String())
+	}
+	return in.String()
+}
+
+func BenchmarkParseV2(b *testing.B) {
+	in := benchmarkV2Source(b, 5000)
+	source, _ := NewSourceFromString("bench", in, SourceFormatV2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := source.Parse(""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseStreamV2(b *testing.B) {
+	in := benchmarkV2Source(b, 5000)
+	source, _ := NewSourceFromString("bench", in, SourceFormatV2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		if err := source.ParseStream(strings.NewReader(in), "", func(RegisteredServer) error { count++; return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRefreshJitter(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	in := testV2Source(t, "server")
+	server.set("/list.md", in)
+	server.set("/list.md.minisig", signer.sign(in, "timestamp:100"))
+	// Look for a seed that schedules the refresh early, which is the case the
+	// cache freshness has to agree with
+	fetchOptions := SourceFetchOptions{jitterPercent: 50}
+	for i := 0; ; i++ {
+		fetchOptions.jitterSeed = fmt.Sprintf("seed-%d", i)
+		fetchOptions.initJitter(server.URL + "/list.md")
+		if fetchOptions.jitterRatio < -0.2 {
+			break
+		}
+	}
+	cacheFile := filepath.Join(dir, "cache.md")
+	source, urlsToPrefetch := loadTestSource(t, server.URL+"/list.md", signer, cacheFile, fetchOptions)
+	if !source.when.Equal(urlsToPrefetch[0].when) {
+		t.Fatalf("The source and its prefetching were scheduled differently: %v, %v", source.when, urlsToPrefetch[0].when)
+	}
+	expectedDelay := source.fetchOptions.jitter(time.Hour)
+	if delay := source.when.Sub(source.lastUpdate); delay < expectedDelay-time.Second || delay > expectedDelay+time.Second || delay > 54*time.Minute {
+		t.Fatalf("Unexpected jittered delay: %v, expected %v", delay, expectedDelay)
+	}
+	again, _ := loadTestSource(t, server.URL+"/list.md", signer, filepath.Join(dir, "again.md"), fetchOptions)
+	if again.fetchOptions.jitterRatio != source.fetchOptions.jitterRatio {
+		t.Fatal("The jitter of a seeded source changed")
+	}
+
+	// The source is downloaded again once the jittered delay has elapsed, not
+	// after the refresh delay
+	requests := server.requestCount("/list.md")
+	restoreNow := setTestNow(expectedDelay - time.Minute)
+	PrefetchSourceURL(context.Background(), &urlsToPrefetch[0])
+	restoreNow()
+	if server.requestCount("/list.md") != requests {
+		t.Fatal("The source was downloaded before the jittered delay")
+	}
+	restoreNow = setTestNow(expectedDelay + time.Minute)
+	PrefetchSourceURL(context.Background(), &urlsToPrefetch[0])
+	restoreNow()
+	if server.requestCount("/list.md") != requests+1 {
+		t.Fatal("The source was not downloaded after the jittered delay")
+	}
+	if delay := urlsToPrefetch[0].when.Sub(SourcesNow().Add(expectedDelay + time.Minute)); delay < expectedDelay-time.Second || delay > expectedDelay+time.Second {
+		t.Fatalf("Unexpected delay after a refresh: %v, expected %v", delay, expectedDelay)
+	}
+
+	server.mu.Lock()
+	server.unavailable = true
+	server.mu.Unlock()
+	defer setTestNow(2 * time.Hour)()
+	PrefetchSourceURL(context.Background(), &urlsToPrefetch[0])
+	if urlsToPrefetch[0].failures != 1 {
+		t.Fatal("Prefetching an unavailable source succeeded")
+	}
+	if delay := urlsToPrefetch[0].when.Sub(SourcesNow()); delay < 2*time.Hour-time.Minute || delay > 2*time.Hour {
+		t.Fatalf("The delay requested by the server was not honored: %v", delay)
+	}
+}
+
+func TestCacheModifiedInTheFuture(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	cacheFile := filepath.Join(dir, "cache.md")
+	first := testV2Source(t, "first")
+	server.set("/list.md", first)
+	server.set("/list.md.minisig", signer.sign(first, "timestamp:100"))
+	loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{})
+
+	future := time.Now().Add(48 * time.Hour)
+	for _, file := range []string{cacheFile, cacheFile + ".minisig"} {
+		if err := os.Chtimes(file, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, delay, err := fetchFromCache(cacheFile, time.Hour); err != nil || delay != 0 {
+		t.Fatalf("A cache file modified in the future is considered fresh for %v (%v)", delay, err)
+	}
+	second := testV2Source(t, "second")
+	server.set("/list.md", second)
+	server.set("/list.md.minisig", signer.sign(second, "timestamp:200"))
+	if source, _ := loadTestSource(t, server.URL+"/list.md", signer, cacheFile, SourceFetchOptions{}); source.in != second {
+		t.Fatal("The cache file was not refreshed")
+	}
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	signer := newTestSigner(t)
+	in := testV2Source(t, "server")
+	tests := []struct {
+		name       string
+		sigStr     string
+		algorithms []string
+		fails      bool
+	}{
+		{"legacy", signer.sign(in, "timestamp:100"), nil, false},
+		{"prehashed", signer.signPrehashed(in, "timestamp:100"), nil, false},
+		{"prehashed, allowed", signer.signPrehashed(in, "timestamp:100"), []string{"prehashed"}, false},
+		{"prehashed, not allowed", signer.signPrehashed(in, "timestamp:100"), []string{"legacy"}, true},
+		{"legacy, not allowed", signer.sign(in, "timestamp:100"), []string{"prehashed"}, true},
+		{"prehashed, other content", signer.signPrehashed(in+"\n", "timestamp:100"), nil, true},
+		{"prehashed, modified trusted comment", strings.Replace(signer.signPrehashed(in, "timestamp:100"), "timestamp:100", "timestamp:999", 1), nil, true},
+	}
+	for _, test := range tests {
+		source, err := NewSourceFromString(test.name, in, SourceFormatV2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source.minisignKeys, err = parseMinisignKeys(signer.publicKeyStr()); err != nil {
+			t.Fatal(err)
+		}
+		source.fetchOptions.sigAlgorithms = test.algorithms
+		if _, err := source.verifySignature(in, test.sigStr); (err != nil) != test.fails {
+			t.Errorf("%s: unexpected result: %v", test.name, err)
+		}
+	}
+}
+
+func TestConcurrentFetchesAreQueued(t *testing.T) {
+	const maxFetches, fetches = 2, 6
+	SetSourcesFetchConcurrency(maxFetches)
+	defer SetSourcesFetchConcurrency(DefaultSourceFetchConcurrency)
+	in := testV2Source(t, "server")
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		<-unblock
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, in)
+	}))
+	defer server.Close()
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+
+	errs := make(chan error, fetches)
+	for i := 0; i < fetches; i++ {
+		go func(i int) {
+			url := fmt.Sprintf("%s/list-%d.md", server.URL, i)
+			var out string
+			var err error
+			if i%2 == 0 {
+				cacheFile := filepath.Join(dir, fmt.Sprintf("cache-%d.md", i))
+				out, _, _, _, err = fetchWithCache(context.Background(), url, cacheFile, time.Hour, &SourceFetchOptions{})
+			} else {
+				// Uncached downloads, such as signatures, share the same slots
+				out, err = fetchFromURL(context.Background(), url, true, &SourceFetchOptions{})
+			}
+			if err == nil && out != in {
+				err = fmt.Errorf("Unexpected content for fetch %d", i)
+			}
+			errs <- err
+		}(i)
+	}
+	// Wait for the first fetches to reach the server, and give the other
+	// ones a chance to start if they weren't queued
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		started := inFlight
+		mu.Unlock()
+		if started == maxFetches {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d fetches started", started)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("A fetch returned while the others were blocked: %v", err)
+	default:
+	}
+	close(unblock)
+	for i := 0; i < fetches; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Queued fetch failed: %v", err)
+		}
+	}
+	if maxInFlight != maxFetches {
+		t.Errorf("%d concurrent fetches, expected at most %d", maxInFlight, maxFetches)
+	}
+}
+
+func TestQueuedFetchSlotCanBeCancelled(t *testing.T) {
+	SetSourcesFetchConcurrency(1)
+	defer SetSourcesFetchConcurrency(DefaultSourceFetchConcurrency)
+	release, err := acquireFetchSlot(context.Background(), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireFetchSlot(ctx, "second"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the queued fetch to time out, got %v", err)
+	}
+	acquired := make(chan func())
+	go func() {
+		release, err := acquireFetchSlot(context.Background(), "third")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("A slot was acquired while all of them were in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("The queued fetch didn't get the released slot")
+	}
+}
+
+// testBrotliStored encodes in as a Brotli stream made of uncompressed
+// meta-blocks, since only the decoder is vendored.
+func testBrotliStored(in []byte) []byte {
+	var out []byte
+	var bits, bitCount uint
+	writeBits := func(value uint, count uint) {
+		bits |= value << bitCount
+		for bitCount += count; bitCount >= 8; bitCount -= 8 {
+			out = append(out, byte(bits))
+			bits >>= 8
+		}
+	}
+	flush := func() {
+		if bitCount > 0 {
+			out = append(out, byte(bits))
+			bits, bitCount = 0, 0
+		}
+	}
+	writeBits(0, 1) // WBITS = 16
+	for len(in) > 0 {
+		block := in
+		if len(block) > 1<<16 {
+			block = block[:1<<16]
+		}
+		writeBits(0, 1)                   // ISLAST
+		writeBits(0, 2)                   // MNIBBLES = 4
+		writeBits(uint(len(block)-1), 16) // MLEN - 1
+		writeBits(1, 1)                   // ISUNCOMPRESSED
+		flush()
+		out = append(out, block...)
+		in = in[len(block):]
+	}
+	writeBits(3, 2) // ISLAST, ISLASTEMPTY
+	flush()
+	return out
+}
+
+func TestBrotliEncodedSource(t *testing.T) {
+	signer := newTestSigner(t)
+	in := testV2Source(t, "first", "second")
+	compressed := testBrotliStored([]byte(in))
+	sigStr := signer.sign(in, "timestamp:100")
+	tests := []struct {
+		name        string
+		withBrotli  bool
+		serveBrotli bool
+	}{
+		{"brotli", true, true},
+		{"identity", true, false},
+		{"brotli disabled", false, false},
+	}
+	for _, test := range tests {
+		func() {
+			if !test.withBrotli {
+				decoder := SourceContentDecoders["br"]
+				delete(SourceContentDecoders, "br")
+				defer func() { SourceContentDecoders["br"] = decoder }()
+			}
+			var acceptEncoding string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, ".minisig") {
+					fmt.Fprint(w, sigStr)
+					return
+				}
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				if test.serveBrotli {
+					w.Header().Set("Content-Encoding", "br")
+					w.Write(compressed)
+					return
+				}
+				fmt.Fprint(w, in)
+			}))
+			defer server.Close()
+			dir, cleanup := testTempDir(t)
+			defer cleanup()
+
+			source, _ := loadTestSource(t, server.URL+"/list.md", signer, filepath.Join(dir, "cache.md"), SourceFetchOptions{})
+			if advertised := strings.Contains(acceptEncoding, "br"); advertised != test.withBrotli {
+				t.Errorf("%s: unexpected Accept-Encoding [%s]", test.name, acceptEncoding)
+			}
+			if source.in != in {
+				t.Errorf("%s: the source was not decoded", test.name)
+			}
+			if cached := checkCachedPair(t, &source); cached != in {
+				t.Errorf("%s: the cached source was not decoded", test.name)
+			}
+		}()
+	}
+}
+
+func TestPrefetchBackoff(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	signer := newTestSigner(t)
+	in := testV2Source(t, "server")
+	sigStr := signer.sign(in, "timestamp:100")
+	var mu sync.Mutex
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".minisig") {
+			fmt.Fprint(w, sigStr)
+			return
+		}
+		fmt.Fprint(w, in)
+	}))
+	defer server.Close()
+	refreshDelay := 24 * time.Hour
+	_, urlsToPrefetch, err := NewSource(context.Background(), server.URL+"/list.md", nil, signer.publicKeyStr(), filepath.Join(dir, "cache.md"), "v2", refreshDelay, SourceFetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlToPrefetch := &urlsToPrefetch[0]
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	defer setTestNow(refreshDelay + time.Hour)()
+	expected := []time.Duration{
+		SourcePrefetchMinBackoff, 2 * SourcePrefetchMinBackoff, 4 * SourcePrefetchMinBackoff, 8 * SourcePrefetchMinBackoff,
+		16 * SourcePrefetchMinBackoff, 32 * SourcePrefetchMinBackoff, 64 * SourcePrefetchMinBackoff,
+		SourcePrefetchMaxBackoff, SourcePrefetchMaxBackoff,
+	}
+	for i, expectedDelay := range expected {
+		PrefetchSourceURL(context.Background(), urlToPrefetch)
+		if urlToPrefetch.failures != i+1 {
+			t.Fatalf("Expected %d consecutive failures, got %d", i+1, urlToPrefetch.failures)
+		}
+		if delay := urlToPrefetch.when.Sub(SourcesNow()); delay > expectedDelay || delay < expectedDelay-time.Second {
+			t.Fatalf("Failure %d: next attempt in %v, expected %v", i+1, delay, expectedDelay)
+		}
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if err := PrefetchSourceURL(context.Background(), urlToPrefetch); err != nil {
+		t.Fatal(err)
+	}
+	if urlToPrefetch.failures != 0 {
+		t.Fatalf("%d failures after a successful prefetch", urlToPrefetch.failures)
+	}
+	if delay := urlToPrefetch.when.Sub(SourcesNow()); delay > refreshDelay || delay < refreshDelay-time.Second {
+		t.Fatalf("Next refresh in %v after a successful prefetch, expected %v", delay, refreshDelay)
+	}
+}
+
+func TestNegativeCacheDoesNotBlockMirrors(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+	in := testV2Source(t, "server")
+	server.set("/mirror/list.md", in)
+	server.set("/mirror/list.md.minisig", signer.sign(in, "timestamp:100"))
+	primaryURL, mirrorURL := server.URL+"/gone/list.md", server.URL+"/mirror/list.md"
+	cacheFile := filepath.Join(dir, "cache.md")
+	metrics := &testSourceMetrics{fetchFailures: make(map[string]int)}
+	SourcesMetrics = metrics
+	defer func() { SourcesMetrics = noSourceMetrics{} }()
+	fetchOptions := SourceFetchOptions{negativeCacheTTL: 24 * time.Hour}
+	source, urlsToPrefetch, err := NewSource(context.Background(), primaryURL, []string{mirrorURL}, signer.publicKeyStr(), cacheFile, "v2", time.Hour, fetchOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.in != in {
+		t.Fatal("The source was not loaded from the mirror")
+	}
+	if status, _, ok := loadNegativeCache(cacheFile, primaryURL); !ok || status != http.StatusNotFound {
+		t.Fatal("The 404 from the primary URL was not cached")
+	}
+	if _, _, ok := loadNegativeCache(cacheFile, mirrorURL); ok {
+		t.Fatal("The mirror was marked as failing")
+	}
+
+	// Once the cache has expired, the primary URL is skipped, but the mirror
+	// is still used.
+	defer setTestNow(2 * time.Hour)()
+	updated := testV2Source(t, "server", "other")
+	server.set("/mirror/list.md", updated)
+	server.set("/mirror/list.md.minisig", signer.sign(updated, "timestamp:200"))
+	primaryRequests := server.requestCount("/gone/list.md")
+	if err := PrefetchSourceURL(context.Background(), &urlsToPrefetch[0]); err != nil {
+		t.Fatal(err)
+	}
+	if server.requestCount("/gone/list.md") != primaryRequests {
+		t.Fatal("The primary URL was retried despite its cached 404")
+	}
+	if failures := metrics.failures(primaryURL); failures != 1 {
+		t.Fatalf("%d failed downloads reported for the primary URL, expected 1", failures)
+	}
+	if urlsToPrefetch[0].failures != 0 || checkCachedPair(t, &source) != updated {
+		t.Fatal("The source was not updated from the mirror")
+	}
+	if _, _, ok := loadNegativeCache(cacheFile, primaryURL); !ok {
+		t.Fatal("A successful download from the mirror cleared the 404 of the primary URL")
+	}
+}
+
+func TestCompactOnlyRemovesSidecarsOfUnreferencedSources(t *testing.T) {
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	files := []string{
+		"active.md", "active.md.minisig", "active.md.etag", "active.md.good.minisig",
+		"gone.md", "gone.md.minisig", "gone.md.etag", "gone.md.minisig.etag", "gone.md.part",
+		"notes.txt", "notes.txt.bak",
+	}
+	for _, file := range files {
+		writeTestFile(t, filepath.Join(dir, file), "content")
+	}
+	active := []string{filepath.Join(dir, "active.md"), filepath.Join(dir, "active.md.minisig")}
+	expected := []string{"gone.md.etag", "gone.md.minisig", "gone.md.minisig.etag", "gone.md.part"}
+	for _, dryRun := range []bool{true, false} {
+		removed, err := Compact(dir, active, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, file := range removed {
+			names = append(names, filepath.Base(file))
+		}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Fatalf("dryRun=%v: removed %v, expected %v", dryRun, names, expected)
+		}
+	}
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(dir, file))
+		if wasRemoved := os.IsNotExist(err); wasRemoved != strings.HasPrefix(file, "gone.md.") {
+			t.Errorf("[%s]: removed=%v", file, wasRemoved)
+		}
+	}
+}
+
+type testSourceMetrics struct {
+	noSourceMetrics
+	mu            sync.Mutex
+	fetchFailures map[string]int
+}
+
+func (metrics *testSourceMetrics) FetchFailed(url string, statusCode int) {
+	metrics.mu.Lock()
+	metrics.fetchFailures[url]++
+	metrics.mu.Unlock()
+}
+
+func (metrics *testSourceMetrics) failures(url string) int {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.fetchFailures[url]
+}
+
+type testSourceObserver struct {
+	mu     sync.Mutex
+	states []SourceState
+	last   time.Time
+}
+
+func (observer *testSourceObserver) SourceStateChanged(url string, state SourceState, since time.Time, lastSuccess time.Time) {
+	observer.mu.Lock()
+	observer.states = append(observer.states, state)
+	observer.last = lastSuccess
+	observer.mu.Unlock()
+}
+
+func (observer *testSourceObserver) check(t *testing.T, step string, states ...SourceState) time.Time {
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if fmt.Sprint(observer.states) != fmt.Sprint(states) {
+		t.Fatalf("%s: expected states %v, got %v", step, states, observer.states)
+	}
+	return observer.last
+}
+
+func TestSourceStateTransitions(t *testing.T) {
+	observer := &testSourceObserver{}
+	SourcesObserver = observer
+	defer func() { SourcesObserver = noSourceObserver{} }()
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	server := newTestSourceServer()
+	defer server.Close()
+	signer := newTestSigner(t)
+
+	if _, _, err := NewSource(context.Background(), server.URL+"/list.md", nil, signer.publicKeyStr(), filepath.Join(dir, "missing.md"), "v2", time.Hour, SourceFetchOptions{}); err == nil {
+		t.Fatal("A missing source was loaded")
+	}
+	if lastSuccess := observer.check(t, "missing source", SourceStateRefreshFailed); !lastSuccess.IsZero() {
+		t.Fatalf("Unexpected last success for a missing source: %v", lastSuccess)
+	}
+
+	observer.states = nil
+	first := testV2Source(t, "first")
+	server.set("/list.md", first)
+	server.set("/list.md.minisig", signer.sign(first, "timestamp:100"))
+	_, urlsToPrefetch := loadTestSource(t, server.URL+"/list.md", signer, filepath.Join(dir, "cache.md"), SourceFetchOptions{})
+	loaded := observer.check(t, "initial load", SourceStateLoadedFresh)
+	if loaded.IsZero() {
+		t.Fatal("No last success after the source was loaded")
+	}
+
+	defer setTestNow(2 * time.Hour)()
+	second := testV2Source(t, "first", "second")
+	server.set("/list.md", second)
+	server.set("/list.md.minisig", signer.sign(first, "timestamp:200"))
+	PrefetchSourceURL(context.Background(), &urlsToPrefetch[0])
+	if lastSuccess := observer.check(t, "invalid signature", SourceStateLoadedFresh, SourceStateSignatureInvalid); !lastSuccess.Equal(loaded) {
+		t.Fatalf("The last success changed after an invalid signature: %v, %v", lastSuccess, loaded)
+	}
+
+	server.set("/list.md.minisig", signer.sign(second, "timestamp:200"))
+	PrefetchSourceURL(context.Background(), &urlsToPrefetch[0])
+	observer.check(t, "valid signature", SourceStateLoadedFresh, SourceStateSignatureInvalid, SourceStateLoadedFresh)
+
+	server.mu.Lock()
+	server.unavailable = true
+	server.mu.Unlock()
+	defer setTestNow(4 * time.Hour)()
+	PrefetchSourceURL(context.Background(), &urlsToPrefetch[0])
+	observer.check(t, "unavailable", SourceStateLoadedFresh, SourceStateSignatureInvalid, SourceStateLoadedFresh, SourceStateServedFromCache)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/jedisct1/dlog"
@@ -16,11 +17,26 @@ import (
 type StampProtoType uint8
 
 const (
-	StampProtoTypePlain    = StampProtoType(0x00)
-	StampProtoTypeDNSCrypt = StampProtoType(0x01)
-	StampProtoTypeDoH      = StampProtoType(0x02)
+	StampProtoTypePlain         = StampProtoType(0x00)
+	StampProtoTypeDNSCrypt      = StampProtoType(0x01)
+	StampProtoTypeDoH           = StampProtoType(0x02)
+	StampProtoTypeDNSCryptRelay = StampProtoType(0x81)
 )
 
+func (proto StampProtoType) String() string {
+	switch proto {
+	case StampProtoTypePlain:
+		return "Plain"
+	case StampProtoTypeDNSCrypt:
+		return "DNSCrypt"
+	case StampProtoTypeDoH:
+		return "DoH"
+	case StampProtoTypeDNSCryptRelay:
+		return "DNSCrypt relay"
+	}
+	return "Unknown"
+}
+
 type ServerStamp struct {
 	serverAddrStr string
 	serverPk      []uint8
@@ -31,10 +47,53 @@ type ServerStamp struct {
 	proto         StampProtoType
 }
 
-func NewDNSCryptServerStampFromLegacy(serverAddrStr string, serverPkStr string, providerName string, props ServerInformalProperties) (ServerStamp, error) {
-	if net.ParseIP(serverAddrStr) != nil {
-		serverAddrStr = fmt.Sprintf("%s:%d", serverAddrStr, DefaultPort)
+// canonicalServerAddr returns addr with an explicit port, and brackets around
+// IPv6 addresses, which is how addresses are encoded in stamps.
+func canonicalServerAddr(addr string) string {
+	if net.ParseIP(addr) != nil {
+		return net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return net.JoinHostPort(addr[1:len(addr)-1], strconv.Itoa(DefaultPort))
+	}
+	return addr
+}
+
+// canonicalStampString encodes stamp with an explicit port, so that a stamp
+// built from a v1 entry matches the equivalent v2 stamp.
+func canonicalStampString(stamp ServerStamp) string {
+	if stamp.proto == StampProtoTypeDNSCrypt || stamp.proto == StampProtoTypeDNSCryptRelay {
+		stamp.serverAddrStr = canonicalServerAddr(stamp.serverAddrStr)
+	}
+	return stamp.String()
+}
+
+// CanonicalStamp decodes stampStr and encodes it again, without padding, with
+// a lowercase scheme, and with an explicit port for DNSCrypt servers and relays.
+func CanonicalStamp(stampStr string) (string, error) {
+	if len(stampStr) >= 7 && strings.EqualFold(stampStr[:7], "sdns://") {
+		stampStr = "sdns://" + stampStr[7:]
+	}
+	stamp, err := NewServerStampFromString(stampStr)
+	if err != nil {
+		return "", err
 	}
+	return canonicalStampString(stamp), nil
+}
+
+// StampsEqual returns true if both stamps are valid and describe the same
+// server.
+func StampsEqual(a string, b string) bool {
+	canonicalA, err := CanonicalStamp(a)
+	if err != nil {
+		return false
+	}
+	canonicalB, err := CanonicalStamp(b)
+	return err == nil && canonicalA == canonicalB
+}
+
+func NewDNSCryptServerStampFromLegacy(serverAddrStr string, serverPkStr string, providerName string, props ServerInformalProperties) (ServerStamp, error) {
+	serverAddrStr = canonicalServerAddr(serverAddrStr)
 	serverPk, err := hex.DecodeString(strings.Replace(serverPkStr, ":", "", -1))
 	if err != nil || len(serverPk) != ed25519.PublicKeySize {
 		return ServerStamp{}, fmt.Errorf("Unsupported public key: [%s]", serverPkStr)
@@ -52,7 +111,7 @@ func NewServerStampFromString(stampStr string) (ServerStamp, error) {
 	if !strings.HasPrefix(stampStr, "sdns://") && !strings.HasPrefix(stampStr, "dnsc://") {
 		return ServerStamp{}, errors.New("Stamps are expected to start with sdns://")
 	}
-	bin, err := base64.RawURLEncoding.DecodeString(stampStr[7:])
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(stampStr[7:], "="))
 	if err != nil {
 		return ServerStamp{}, err
 	}
@@ -63,6 +122,8 @@ func NewServerStampFromString(stampStr string) (ServerStamp, error) {
 		return newDNSCryptServerStamp(bin)
 	} else if bin[0] == uint8(StampProtoTypeDoH) {
 		return newDoHServerStamp(bin)
+	} else if bin[0] == uint8(StampProtoTypeDNSCryptRelay) {
+		return newDNSCryptRelayStamp(bin)
 	}
 	return ServerStamp{}, errors.New("Unsupported stamp version or protocol")
 }
@@ -70,7 +131,7 @@ func NewServerStampFromString(stampStr string) (ServerStamp, error) {
 // id(u8)=0x02 props addrLen(1) serverAddr pkStrlen(1) pkStr providerNameLen(1) providerName
 
 func newDNSCryptServerStamp(bin []byte) (ServerStamp, error) {
-	stamp := ServerStamp{proto:StampProtoTypeDNSCrypt}
+	stamp := ServerStamp{proto: StampProtoTypeDNSCrypt}
 	if len(bin) < 24 {
 		return stamp, errors.New("Stamp is too short")
 	}
@@ -111,7 +172,7 @@ func newDNSCryptServerStamp(bin []byte) (ServerStamp, error) {
 // id(u8)=0x02 props addrLen(1) serverAddr hashLen(1) hash providerNameLen(1) providerName pathLen(1) path
 
 func newDoHServerStamp(bin []byte) (ServerStamp, error) {
-	stamp := ServerStamp{proto:StampProtoTypeDoH}
+	stamp := ServerStamp{proto: StampProtoTypeDoH}
 
 	stamp.props = ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
 	binLen := len(bin)
@@ -138,7 +199,11 @@ func newDoHServerStamp(bin []byte) (ServerStamp, error) {
 		return stamp, errors.New("Invalid stamp")
 	}
 	pos++
-	stamp.providerName = string(bin[pos : pos+len])
+	providerName, err := idnaToASCII(string(bin[pos : pos+len]))
+	if err != nil {
+		return stamp, err
+	}
+	stamp.providerName = providerName
 	pos += len
 
 	len = int(bin[pos])
@@ -155,11 +220,37 @@ func newDoHServerStamp(bin []byte) (ServerStamp, error) {
 	return stamp, nil
 }
 
+// id(u8)=0x81 addrLen(1) serverAddr
+
+func newDNSCryptRelayStamp(bin []byte) (ServerStamp, error) {
+	stamp := ServerStamp{proto: StampProtoTypeDNSCryptRelay}
+	if len(bin) < 2 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	binLen := len(bin)
+	pos := 1
+
+	len := int(bin[pos])
+	if 1+len > binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.serverAddrStr = string(bin[pos : pos+len])
+	pos += len
+
+	if pos != binLen {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	return stamp, nil
+}
+
 func (stamp *ServerStamp) String() string {
 	if stamp.proto == StampProtoTypeDNSCrypt {
 		return stamp.dnsCryptString()
 	} else if stamp.proto == StampProtoTypeDoH {
 		return stamp.dohString()
+	} else if stamp.proto == StampProtoTypeDNSCryptRelay {
+		return stamp.dnsCryptRelayString()
 	}
 	dlog.Fatal("Unsupported protocol")
 	return ""
@@ -205,3 +296,15 @@ func (stamp *ServerStamp) dohString() string {
 
 	return "sdns://" + str
 }
+
+func (stamp *ServerStamp) dnsCryptRelayString() string {
+	bin := make([]uint8, 1)
+	bin[0] = uint8(StampProtoTypeDNSCryptRelay)
+
+	bin = append(bin, uint8(len(stamp.serverAddrStr)))
+	bin = append(bin, []uint8(stamp.serverAddrStr)...)
+
+	str := base64.RawURLEncoding.EncodeToString(bin)
+
+	return "sdns://" + str
+}
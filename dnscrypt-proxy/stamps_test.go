@@ -0,0 +1,178 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testServerStamp(serverAddrStr string) ServerStamp {
+	return ServerStamp{
+		serverAddrStr: serverAddrStr,
+		serverPk:      []uint8(strings.Repeat("\xab", 32)),
+		providerName:  "2.dnscrypt-cert.example",
+		props:         ServerInformalPropertyDNSSEC | ServerInformalPropertyNoLog,
+		proto:         StampProtoTypeDNSCrypt,
+	}
+}
+
+func TestCanonicalStampOfLegacyEntries(t *testing.T) {
+	tests := []struct {
+		legacyAddr string
+		stampAddr  string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1:443"},
+		{"192.0.2.1:443", "192.0.2.1"},
+		{"192.0.2.1:5353", "192.0.2.1:5353"},
+		{"2001:db8::1", "[2001:db8::1]"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"[2001:db8::1]:443", "[2001:db8::1]"},
+	}
+	for _, test := range tests {
+		legacyStamp, err := NewDNSCryptServerStampFromLegacy(test.legacyAddr, strings.Repeat("AB", 32), "2.dnscrypt-cert.example", ServerInformalPropertyDNSSEC|ServerInformalPropertyNoLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamp := testServerStamp(test.stampAddr)
+		if canonicalStampString(legacyStamp) != canonicalStampString(stamp) {
+			t.Errorf("[%s] (v1) and [%s] (v2) don't have the same canonical stamp", test.legacyAddr, test.stampAddr)
+		}
+		if !StampsEqual(legacyStamp.String(), stamp.String()) {
+			t.Errorf("[%s] (v1) and [%s] (v2) are not equal", test.legacyAddr, test.stampAddr)
+		}
+	}
+}
+
+func TestCanonicalStampKeepsDifferences(t *testing.T) {
+	tests := []struct {
+		a string
+		b string
+	}{
+		{"192.0.2.1", "192.0.2.2"},
+		{"192.0.2.1", "192.0.2.1:5353"},
+		{"[2001:db8::1]", "[2001:db8::2]"},
+	}
+	for _, test := range tests {
+		a, b := testServerStamp(test.a), testServerStamp(test.b)
+		if canonicalStampString(a) == canonicalStampString(b) {
+			t.Errorf("[%s] and [%s] have the same canonical stamp", test.a, test.b)
+		}
+	}
+	a, b := testServerStamp("192.0.2.1"), testServerStamp("192.0.2.1")
+	b.providerName = "2.dnscrypt-cert.other"
+	if canonicalStampString(a) == canonicalStampString(b) {
+		t.Error("Stamps with different provider names have the same canonical stamp")
+	}
+}
+
+func TestRemoveDuplicateStampsAcrossFormats(t *testing.T) {
+	legacyStamp, err := NewDNSCryptServerStampFromLegacy("192.0.2.1", strings.Repeat("AB", 32), "2.dnscrypt-cert.example", ServerInformalPropertyDNSSEC|ServerInformalPropertyNoLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registeredServers := removeDuplicateStamps([]RegisteredServer{
+		{name: "v1", stamp: legacyStamp},
+		{name: "v2", stamp: testServerStamp("192.0.2.1")},
+		{name: "other", stamp: testServerStamp("192.0.2.2")},
+	})
+	if len(registeredServers) != 2 || registeredServers[0].name != "v1" || registeredServers[1].name != "other" {
+		t.Fatalf("Unexpected servers: %v", registeredServerNames(registeredServers))
+	}
+}
+
+func testPaddedStamp(stampStr string) string {
+	return stampStr + strings.Repeat("=", (4-(len(stampStr)-7)%4)%4+4)
+}
+
+func TestStampsEqual(t *testing.T) {
+	implicitPort, explicitPort := testServerStamp("192.0.2.1"), testServerStamp("192.0.2.1:443")
+	implicitPort6, explicitPort6 := testServerStamp("[2001:db8::1]"), testServerStamp("[2001:db8::1]:443")
+	otherPort := testServerStamp("192.0.2.1:5353")
+	stampStr := implicitPort.String()
+	tests := []struct {
+		a     string
+		b     string
+		equal bool
+	}{
+		{stampStr, stampStr, true},
+		{stampStr, explicitPort.String(), true},
+		{implicitPort6.String(), explicitPort6.String(), true},
+		{stampStr, testPaddedStamp(stampStr), true},
+		{stampStr, "SDNS://" + stampStr[7:], true},
+		{stampStr, "Sdns://" + testPaddedStamp(explicitPort.String())[7:], true},
+		{stampStr, otherPort.String(), false},
+		{stampStr, implicitPort6.String(), false},
+		{stampStr, "sdns://invalid", false},
+		{"sdns://invalid", "sdns://invalid", false},
+	}
+	for _, test := range tests {
+		if StampsEqual(test.a, test.b) != test.equal {
+			t.Errorf("StampsEqual([%s], [%s]) should be %v", test.a, test.b, test.equal)
+		}
+		if StampsEqual(test.b, test.a) != test.equal {
+			t.Errorf("StampsEqual([%s], [%s]) should be %v", test.b, test.a, test.equal)
+		}
+	}
+	canonical, err := CanonicalStamp("SDNS://" + testPaddedStamp(stampStr)[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonical != explicitPort.String() {
+		t.Errorf("Unexpected canonical stamp [%s], expected [%s]", canonical, explicitPort.String())
+	}
+}
+
+func TestServersBlacklistWithEquivalentStamps(t *testing.T) {
+	implicitPort, explicitPort := testServerStamp("192.0.2.1"), testServerStamp("192.0.2.1:443")
+	tests := []struct {
+		name        string
+		blacklisted string
+		stamp       ServerStamp
+		removed     bool
+	}{
+		{"same stamp", implicitPort.String(), implicitPort, true},
+		{"explicit port in the blacklist", explicitPort.String(), implicitPort, true},
+		{"explicit port in the source", implicitPort.String(), explicitPort, true},
+		{"padding", testPaddedStamp(implicitPort.String()), implicitPort, true},
+		{"uppercase scheme", "SDNS://" + explicitPort.String()[7:], implicitPort, true},
+		{"other server", implicitPort.String(), testServerStamp("192.0.2.2"), false},
+		{"other port", implicitPort.String(), testServerStamp("192.0.2.1:5353"), false},
+	}
+	dir, cleanup := testTempDir(t)
+	defer cleanup()
+	for _, test := range tests {
+		file := filepath.Join(dir, "blacklist.txt")
+		writeTestFile(t, file, "# blacklisted servers\n"+test.blacklisted+"\n")
+		blacklist, err := LoadServersBlacklist(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filteredServers := blacklist.Filter("test", []RegisteredServer{{name: "server", stamp: test.stamp}})
+		if (len(filteredServers) == 0) != test.removed {
+			t.Errorf("%s: expected removed=%v, got %v", test.name, test.removed, registeredServerNames(filteredServers))
+		}
+	}
+}
+
+func TestDoHStampWithIDNProviderName(t *testing.T) {
+	tests := []struct {
+		providerName string
+		expected     string
+	}{
+		{"doh.example", "doh.example"},
+		{"doh.example:8443", "doh.example:8443"},
+		{"Bücher.example", "xn--bcher-kva.example"},
+		{"bücher.example:8443", "xn--bcher-kva.example:8443"},
+	}
+	for _, test := range tests {
+		stamp := ServerStamp{proto: StampProtoTypeDoH, providerName: test.providerName, path: "/dns-query"}
+		decoded, err := NewServerStampFromString(stamp.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.providerName != test.expected {
+			t.Errorf("[%s]: decoded as [%s] instead of [%s]", test.providerName, decoded.providerName, test.expected)
+		}
+	}
+}